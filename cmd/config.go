@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/containerd/log"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/sirupsen/logrus"
+
+	"github.com/welteki/zvol-snapshotter/zvol"
+)
+
+// fileConfig is the config file of the process. The settings of the top level
+// snapshotter are set at the top level of the file, next to the settings
+// shared by all snapshotters of the process.
+type fileConfig struct {
+	zvol.Config
+
+	// Address of the socket of the top level snapshotter's gRPC server. The
+	// -address flag takes precedence
+	Address string `toml:"address"`
+
+	// Defines the logging level, like "info" or "debug". The -log-level flag
+	// takes precedence
+	LogLevel string `toml:"log_level"`
+
+	// Tracing configures exporting OpenTelemetry traces
+	Tracing zvol.TracingConfig `toml:"tracing"`
+
+	// Instances are additional snapshotters served by the process, each with
+	// its own address, root_path, dataset and volume settings
+	Instances map[string]*instanceConfig `toml:"instances"`
+}
+
+// instanceConfig configures a snapshotter served on its own socket.
+type instanceConfig struct {
+	zvol.Config
+
+	// Address of the socket of the snapshotter's gRPC server
+	Address string `toml:"address"`
+}
+
+// readConfig reads the config file at path.
+func readConfig(path string) (*fileConfig, error) {
+	configFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer configFile.Close()
+
+	config := &fileConfig{}
+	if err := toml.NewDecoder(configFile).Decode(config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config TOML: %w", err)
+	}
+	return config, nil
+}
+
+// loadConfig reads the config file and applies the command line flags
+// overriding it. A missing config file at the default path is not an error,
+// the default config is used instead.
+func loadConfig() (*fileConfig, error) {
+	config, err := readConfig(*configPath)
+	if err != nil && !(errors.Is(err, fs.ErrNotExist) && *configPath == defaultConfigPath) {
+		return nil, fmt.Errorf("failed to load config file %q: %w", *configPath, err)
+	}
+
+	if config == nil {
+		config = &fileConfig{}
+	}
+
+	if err := config.parse(); err != nil {
+		return nil, fmt.Errorf("failed to load config file %q: %w", *configPath, err)
+	}
+
+	if len(config.RootPath) == 0 {
+		config.RootPath = *rootDir
+	} else if *rootDir != defaultRootDir {
+		config.RootPath = *rootDir
+	}
+
+	if len(config.Address) == 0 {
+		config.Address = *address
+	} else if *address != defaultAddress {
+		config.Address = *address
+	}
+
+	if len(*dataset) > 0 {
+		config.Dataset = *dataset
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid snapshotter config: %w", err)
+	}
+
+	return config, nil
+}
+
+// parse applies the defaults of the snapshotter configs.
+func (c *fileConfig) parse() error {
+	if err := c.Config.Parse(); err != nil {
+		return err
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Instances)) {
+		if err := c.Instances[name].Parse(); err != nil {
+			return fmt.Errorf("instance %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Validate validates the process settings and the config of each snapshotter,
+// and checks that the snapshotters don't share a socket, a root path or a
+// dataset.
+func (c *fileConfig) Validate() error {
+	var result []error
+
+	if c.LogLevel != "" {
+		if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+			result = append(result, fmt.Errorf("unsupported log level: %q", c.LogLevel))
+		}
+	}
+
+	if err := c.Tracing.Validate(); err != nil {
+		result = append(result, err)
+	}
+
+	// A config with instances doesn't need a top level snapshotter
+	if c.Dataset != "" || len(c.Instances) == 0 {
+		if err := c.Config.Validate(); err != nil {
+			result = append(result, err)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.Instances)) {
+		instance := c.Instances[name]
+
+		var errs []error
+		if name == "" {
+			errs = append(errs, fmt.Errorf("name must not be empty"))
+		}
+		if instance.Address == "" {
+			errs = append(errs, fmt.Errorf("address is required"))
+		}
+		if err := instance.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if err := errors.Join(errs...); err != nil {
+			result = append(result, fmt.Errorf("instance %q: %w", name, err))
+		}
+	}
+
+	type snapshotter struct {
+		name   string
+		config *instanceConfig
+	}
+	var snapshotters []snapshotter
+	configs := instanceConfigs(c)
+	for _, name := range slices.Sorted(maps.Keys(configs)) {
+		snapshotters = append(snapshotters, snapshotter{(&instance{name: name}).String(), configs[name]})
+	}
+
+	for i, a := range snapshotters {
+		for _, b := range snapshotters[i+1:] {
+			if a.config.Address != "" && a.config.Address == b.config.Address {
+				result = append(result, fmt.Errorf("%s and %s use the same address %q", a.name, b.name, a.config.Address))
+			}
+			if a.config.RootPath != "" && a.config.RootPath == b.config.RootPath {
+				result = append(result, fmt.Errorf("%s and %s use the same root_path %q", a.name, b.name, a.config.RootPath))
+			}
+			if datasetsOverlap(a.config.Dataset, b.config.Dataset) {
+				result = append(result, fmt.Errorf("dataset %q of %s overlaps dataset %q of %s", a.config.Dataset, a.name, b.config.Dataset, b.name))
+			}
+		}
+	}
+
+	return errors.Join(result...)
+}
+
+// datasetsOverlap reports whether two datasets are the same or one contains
+// the other.
+func datasetsOverlap(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// applyLogLevel sets the log level of the config unless it was set with the
+// -log-level flag.
+func applyLogLevel(config *fileConfig) error {
+	logLevelSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "log-level" {
+			logLevelSet = true
+		}
+	})
+	if logLevelSet {
+		return nil
+	}
+
+	level := config.LogLevel
+	if level == "" {
+		level = defaultLogLevel.String()
+	}
+	return log.SetLevel(level)
+}
+
+// reloader is implemented by snapshotters that can apply a new config while
+// running.
+type reloader interface {
+	CheckConfig(ctx context.Context, config *zvol.Config) error
+	Reload(ctx context.Context, config *zvol.Config) error
+}
+
+// reload reloads the config file and applies it to the snapshotters of the
+// instances, and returns the config running afterwards. The new config is
+// applied to all instances or to none of them: it is checked for every
+// instance first, and the instances already reloaded get their previous
+// config back when applying it to another instance fails.
+func reload(ctx context.Context, running *fileConfig, instances []*instance) *fileConfig {
+	config, err := loadConfig()
+	if err == nil {
+		err = checkReload(ctx, running, config, instances)
+	}
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to reload config, keeping the running config")
+		return running
+	}
+
+	configs := instanceConfigs(config)
+	for i, in := range instances {
+		err := in.sn.(reloader).Reload(in.context(ctx), &configs[in.name].Config)
+		if err == nil {
+			continue
+		}
+
+		log.G(ctx).WithError(fmt.Errorf("%s: %w", in, err)).Error("failed to reload config, keeping the running config")
+		for _, in := range instances[:i] {
+			if err := in.sn.(reloader).Reload(in.context(ctx), &in.config.Config); err != nil {
+				log.G(in.context(ctx)).WithError(err).Error("failed to restore the running config")
+			}
+		}
+		return running
+	}
+
+	for _, in := range instances {
+		in.config = configs[in.name]
+	}
+
+	if err := applyLogLevel(config); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to set log level")
+	}
+
+	return config
+}
+
+// checkReload checks that the new config can be applied to every instance.
+// Adding or removing instances and changing their addresses or the tracing
+// settings requires a restart.
+func checkReload(ctx context.Context, running, config *fileConfig, instances []*instance) error {
+	var errs []error
+
+	if !reflect.DeepEqual(config.Tracing, running.Tracing) {
+		errs = append(errs, errors.New("changing tracing requires a restart"))
+	}
+
+	configs := instanceConfigs(config)
+	for _, in := range instances {
+		instanceConfig, ok := configs[in.name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s was removed, removing it requires a restart", in))
+			continue
+		}
+		delete(configs, in.name)
+
+		if instanceConfig.Address != in.config.Address {
+			errs = append(errs, fmt.Errorf("%s: changing address requires a restart", in))
+			continue
+		}
+
+		r, ok := in.sn.(reloader)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s does not support reloading its config", in))
+			continue
+		}
+		if err := r.CheckConfig(in.context(ctx), &instanceConfig.Config); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", in, err))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(configs)) {
+		errs = append(errs, fmt.Errorf("%s was added, adding it requires a restart", &instance{name: name}))
+	}
+
+	return errors.Join(errs...)
+}
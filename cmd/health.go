@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/containerd/log"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const defaultHealthCheckInterval = 10 * time.Second
+
+// healthChecker is implemented by snapshotters that can check whether they
+// are able to serve requests.
+type healthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// watchHealth checks the snapshotter every interval and sets the serving
+// status of the health service accordingly until the context is done. The
+// status is reported for the snapshots service and for the server as a whole.
+func watchHealth(ctx context.Context, hs *health.Server, checker healthChecker, interval time.Duration) {
+	var last healthpb.HealthCheckResponse_ServingStatus
+
+	check := func() {
+		// A check must not take longer than the interval, a hanging zpool
+		// command means the pool is not healthy.
+		ctx, cancel := context.WithTimeout(ctx, interval)
+		defer cancel()
+
+		status := healthpb.HealthCheckResponse_SERVING
+		err := checker.Check(ctx)
+		if err != nil {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+
+		if status != last {
+			if err != nil {
+				log.G(ctx).WithError(err).Warn("snapshotter is not healthy")
+			} else if last != healthpb.HealthCheckResponse_UNKNOWN {
+				log.G(ctx).Info("snapshotter is healthy again")
+			}
+			last = status
+		}
+
+		hs.SetServingStatus("", status)
+		hs.SetServingStatus(snapshotsapi.Snapshots_ServiceDesc.ServiceName, status)
+	}
+
+	check()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/containerd/containerd/v2/contrib/snapshotservice"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/log"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/welteki/zvol-snapshotter/zvol"
+)
+
+// instance is a snapshotter served on its own socket. The instances of the
+// process share the metrics endpoint and the logger. The top level snapshotter
+// of the config is the instance without name.
+type instance struct {
+	name   string
+	config *instanceConfig
+	sn     snapshots.Snapshotter
+
+	rpc        *grpc.Server
+	health     *health.Server
+	stopHealth context.CancelFunc
+	listener   net.Listener
+	// socket is removed on shutdown. It is empty for a socket passed by
+	// systemd, which is kept for the next start.
+	socket string
+}
+
+func (in *instance) String() string {
+	if in.name == "" {
+		return "top level snapshotter"
+	}
+	return fmt.Sprintf("instance %q", in.name)
+}
+
+// context returns a context logging the name of the instance.
+func (in *instance) context(ctx context.Context) context.Context {
+	if in.name == "" {
+		return ctx
+	}
+	return log.WithLogger(ctx, log.G(ctx).WithField("instance", in.name))
+}
+
+// instanceConfigs returns the configs of the snapshotters to serve by
+// instance name. The top level snapshotter is only served when it has a
+// dataset.
+func instanceConfigs(config *fileConfig) map[string]*instanceConfig {
+	configs := make(map[string]*instanceConfig, len(config.Instances)+1)
+	if config.Dataset != "" {
+		configs[""] = &instanceConfig{Config: config.Config, Address: config.Address}
+	}
+	maps.Copy(configs, config.Instances)
+	return configs
+}
+
+// newInstances creates the snapshotters of the config. The snapshotters
+// created so far are closed when one of them can't be created.
+func newInstances(ctx context.Context, config *fileConfig) ([]*instance, error) {
+	configs := instanceConfigs(config)
+
+	var instances []*instance
+	for _, name := range slices.Sorted(maps.Keys(configs)) {
+		in := &instance{name: name, config: configs[name]}
+
+		sn, err := zvol.NewSnapshotter(in.context(ctx), &in.config.Config)
+		if err != nil {
+			for _, in := range instances {
+				if err := in.sn.Close(); err != nil {
+					log.G(in.context(ctx)).WithError(err).Warn("failed to close snapshotter")
+				}
+			}
+			return nil, fmt.Errorf("%s: %w", in, err)
+		}
+		in.sn = sn
+
+		instances = append(instances, in)
+	}
+	return instances, nil
+}
+
+// listen uses the socket passed by systemd socket activation, or creates the
+// socket of the instance when l is nil.
+func (in *instance) listen(ctx context.Context, l net.Listener) error {
+	if l != nil {
+		log.G(ctx).Infof("using socket %q passed by systemd", l.Addr())
+		in.listener = l
+		return nil
+	}
+
+	addr := in.config.Address
+
+	// Prepare the directory for the socket
+	if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", filepath.Dir(addr), err)
+	}
+
+	// Try to remove the socket file to avoid EADDRINUSE
+	if err := os.RemoveAll(addr); err != nil {
+		return fmt.Errorf("failed to remove %q: %w", addr, err)
+	}
+
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		return fmt.Errorf("error listening on socket %q: %w", addr, err)
+	}
+	in.listener = l
+	in.socket = addr
+	return nil
+}
+
+// start serves the snapshots and health services on the socket of the
+// instance. Serving errors are sent to errChan.
+func (in *instance) start(ctx context.Context, errChan chan<- error) {
+	// Create a gRPC server, tracing requests with the trace context
+	// propagated by containerd
+	in.rpc = grpc.NewServer(grpc.StatsHandler(otelgrpc.NewServerHandler()))
+
+	// Convert the snapshotter to a gRPC service and register it
+	snapshotsapi.RegisterSnapshotsServer(in.rpc, snapshotservice.FromSnapshotter(in.sn))
+
+	// Register the health service, backed by periodic checks of the
+	// metadata store and the ZFS pool when the snapshotter supports them
+	in.health = health.NewServer()
+	healthpb.RegisterHealthServer(in.rpc, in.health)
+
+	var hctx context.Context
+	hctx, in.stopHealth = context.WithCancel(ctx)
+	if checker, ok := in.sn.(healthChecker); ok {
+		go watchHealth(hctx, in.health, checker, *healthInterval)
+	}
+
+	go func() {
+		if err := in.rpc.Serve(in.listener); err != nil {
+			errChan <- fmt.Errorf("error serving %s on socket %q: %w", in, in.listener.Addr(), err)
+		}
+	}()
+}
+
+// shutdown stops accepting requests and waits for running requests up to the
+// shutdown timeout before canceling them. The snapshotter is closed once the
+// gRPC server is stopped, which waits for canceled operations that are still
+// changing volumes, and the socket is removed unless it was passed by systemd.
+func (in *instance) shutdown(ctx context.Context) error {
+	// Stop checking health before the snapshotter is closed, the health
+	// service reports NOT_SERVING from now on.
+	in.stopHealth()
+	in.health.Shutdown()
+
+	stopped := make(chan struct{})
+	go func() {
+		in.rpc.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(*shutdownTimeout):
+		log.G(ctx).Warnf("requests still running after %s, canceling them", *shutdownTimeout)
+		in.rpc.Stop()
+		<-stopped
+	}
+
+	var errs []error
+
+	log.G(ctx).Debug("Closing the snapshotter")
+	if err := in.sn.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close %s: %w", in, err))
+	}
+
+	if in.socket != "" {
+		if err := os.Remove(in.socket); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("failed to remove %q: %w", in.socket, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
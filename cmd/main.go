@@ -5,19 +5,18 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io/fs"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"sync"
+	"time"
 
-	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
-	"github.com/containerd/containerd/v2/contrib/snapshotservice"
-	"github.com/containerd/containerd/v2/core/snapshots"
 	"github.com/containerd/log"
+	"github.com/coreos/go-systemd/v22/daemon"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
-	"google.golang.org/grpc"
 
 	"github.com/welteki/zvol-snapshotter/version"
 	"github.com/welteki/zvol-snapshotter/zvol"
@@ -28,15 +27,20 @@ const (
 	defaultConfigPath = "/etc/containerd-zvol-grpc/config.toml"
 	defaultLogLevel   = log.InfoLevel
 	defaultRootDir    = "/var/lib/containerd-zvol-grpc"
+
+	defaultShutdownTimeout = 30 * time.Second
 )
 
 var (
-	address      = flag.String("address", defaultAddress, "address for the snapshotter's GRPC server")
-	configPath   = flag.String("config", defaultConfigPath, "path to the configuration file")
-	logLevel     = flag.String("log-level", defaultLogLevel.String(), "set the logging level [trace, debug, info, warn, error, fatal, panic]")
-	rootDir      = flag.String("root", defaultRootDir, "path to the root directory for this snapshotter")
-	dataset      = flag.String("dataset", "", "zfs dataset used for snapshots")
-	printVersion = flag.Bool("version", false, "print the version")
+	address         = flag.String("address", defaultAddress, "address for the snapshotter's GRPC server")
+	metricsAddress  = flag.String("metrics-address", "", "address for the Prometheus metrics HTTP server, disabled when empty")
+	configPath      = flag.String("config", defaultConfigPath, "path to the configuration file")
+	logLevel        = flag.String("log-level", defaultLogLevel.String(), "set the logging level [trace, debug, info, warn, error, fatal, panic]")
+	rootDir         = flag.String("root", defaultRootDir, "path to the root directory for this snapshotter")
+	dataset         = flag.String("dataset", "", "zfs dataset used for snapshots")
+	healthInterval  = flag.Duration("health-check-interval", defaultHealthCheckInterval, "interval of the checks backing the gRPC health service")
+	shutdownTimeout = flag.Duration("shutdown-timeout", defaultShutdownTimeout, "time to wait for running requests on shutdown before canceling them")
+	printVersion    = flag.Bool("version", false, "print the version")
 )
 
 func main() {
@@ -59,90 +63,167 @@ func main() {
 		"revision": version.Revision,
 	}).Info("starting containerd-zvol-grpc")
 
-	snapshotterConfig, err := zvol.NewConfigFromToml(*configPath)
-	if err != nil && !(errors.Is(err, fs.ErrNotExist) && *configPath == defaultConfigPath) {
-		log.G(ctx).WithError(err).Fatalf("failed to load config file %q", *configPath)
+	snapshotterConfig, err := loadConfig()
+	if err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to load config")
+	}
+	if err := applyLogLevel(snapshotterConfig); err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to prepare logger")
 	}
 
-	if snapshotterConfig == nil {
-		snapshotterConfig, err = zvol.NewConfig()
-		if err != nil {
-			log.G(ctx).WithError(err).Fatalf("failed to load config")
+	if flag.NArg() > 0 {
+		switch command := flag.Arg(0); command {
+		case "rebuild-metadata":
+			// Rebuild the metadata store from the ZFS user properties of the
+			// snapshot volumes, of the instance named by the next argument or
+			// of the top level snapshotter.
+			name := flag.Arg(1)
+			config, ok := instanceConfigs(snapshotterConfig)[name]
+			if !ok {
+				log.G(ctx).Fatalf("%s is not configured", &instance{name: name})
+			}
+			if err := zvol.RebuildMetadata(ctx, &config.Config); err != nil {
+				log.G(ctx).WithError(err).Fatalf("failed to rebuild metadata")
+			}
+			return
+		default:
+			log.G(ctx).Fatalf("unknown command %q", command)
 		}
 	}
 
-	if len(snapshotterConfig.RootPath) == 0 {
-		snapshotterConfig.RootPath = *rootDir
-	} else if *rootDir != defaultRootDir {
-		snapshotterConfig.RootPath = *rootDir
+	shutdownTracing, err := zvol.SetupTracing(ctx, &snapshotterConfig.Tracing)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to set up tracing")
 	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to flush traces")
+		}
+	}()
 
-	if len(*dataset) > 0 {
-		snapshotterConfig.Dataset = *dataset
+	// Create the snapshotters
+	instances, err := newInstances(ctx, snapshotterConfig)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to create snapshotter")
 	}
 
-	if err := snapshotterConfig.Validate(); err != nil {
-		log.G(ctx).WithError(err).Fatalf("invalid snapshotter config")
+	if err := serve(ctx, snapshotterConfig, instances); err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to serve snapshotter")
 	}
 
-	// Create a gRPC server
-	rpc := grpc.NewServer()
+	log.G(ctx).Info("Exiting")
+}
 
-	// Create snapshotter
-	sn, err := zvol.NewSnapshotter(ctx, snapshotterConfig)
+func serve(ctx context.Context, config *fileConfig, instances []*instance) error {
+	// Use the sockets passed by systemd socket activation, so containerd can
+	// connect before the snapshotters are ready.
+	addrs := make([]string, len(instances))
+	for i, in := range instances {
+		addrs[i] = in.config.Address
+	}
+	listeners, err := activatedListeners(addrs)
 	if err != nil {
-		log.G(ctx).WithError(err).Fatalf("failed to create snapshotter")
+		return err
 	}
 
-	if err := serve(ctx, rpc, *address, sn); err != nil {
-		log.G(ctx).WithError(err).Fatalf("failed to serve snapshotter")
+	for i, in := range instances {
+		var l net.Listener
+		if listeners != nil {
+			l = listeners[i]
+		}
+		if err := in.listen(in.context(ctx), l); err != nil {
+			closeListeners(instances)
+			return err
+		}
 	}
 
-	log.G(ctx).Info("Exiting")
-}
+	errChan := make(chan error, len(instances)+1)
 
-func serve(ctx context.Context, rpc *grpc.Server, addr string, sn snapshots.Snapshotter) error {
-	// Convert the snapshotter to a gRPC service,
-	service := snapshotservice.FromSnapshotter(sn)
+	var metrics *http.Server
+	if *metricsAddress != "" {
+		ml, err := net.Listen("tcp", *metricsAddress)
+		if err != nil {
+			closeListeners(instances)
+			return fmt.Errorf("error listening on metrics address %q: %w", *metricsAddress, err)
+		}
 
-	// Register the service with the gRPC server
-	snapshotsapi.RegisterSnapshotsServer(rpc, service)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		metrics = &http.Server{Handler: mux}
 
-	// Prepare the directory for the socket
-	if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
-		return fmt.Errorf("failed to create directory %q: %w", filepath.Dir(addr), err)
+		log.G(ctx).Infof("serving metrics on %s", ml.Addr())
+		go func() {
+			if err := metrics.Serve(ml); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errChan <- fmt.Errorf("error serving metrics on %q: %w", *metricsAddress, err)
+			}
+		}()
 	}
 
-	// Try to remove the socket file to avoid EADDRINUSE
-	if err := os.RemoveAll(addr); err != nil {
-		return fmt.Errorf("failed to remove %q: %w", addr, err)
+	for _, in := range instances {
+		in.start(in.context(ctx), errChan)
 	}
 
-	// Listen and serve
-	l, err := net.Listen("unix", addr)
-	if err != nil {
-		return fmt.Errorf("error listening on socket %q: %w", addr, err)
-	}
+	// The snapshotters have reconciled their metadata and the sockets accept
+	// connections.
+	notify(ctx, daemon.SdNotifyReady)
 
-	errChan := make(chan error, 1)
-	go func() {
-		if err := rpc.Serve(l); err != nil {
-			errChan <- fmt.Errorf("error serving on socket %q: %w", addr, err)
-		}
-	}()
+	// Keep the watchdog alive while requests are drained on shutdown.
+	wctx, stopWatchdog := context.WithCancel(ctx)
+	defer stopWatchdog()
+	go watchdog(wctx)
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, unix.SIGINT, unix.SIGTERM)
-
-	select {
-	case sig := <-sigChan:
-		log.G(ctx).Infof("Received signal %v", sig)
-		if sig == unix.SIGINT {
-			log.G(ctx).Debug("Closing the snapshotter")
-			sn.Close()
+	signal.Notify(sigChan, unix.SIGINT, unix.SIGTERM, unix.SIGHUP)
+
+wait:
+	for {
+		select {
+		case sig := <-sigChan:
+			if sig == unix.SIGHUP {
+				log.G(ctx).Info("Received SIGHUP, reloading config")
+				config = reload(ctx, config, instances)
+				continue
+			}
+			log.G(ctx).Infof("Received signal %v, shutting down", sig)
+		case err = <-errChan:
+			log.G(ctx).WithError(err).Error("shutting down")
+		}
+		break wait
+	}
+
+	notify(ctx, daemon.SdNotifyStopping)
+
+	return errors.Join(err, shutdown(ctx, instances, metrics))
+}
+
+// shutdown shuts the instances down in parallel, so the shutdown timeout
+// applies to all of them at once, and closes the metrics server afterwards.
+func shutdown(ctx context.Context, instances []*instance, metrics *http.Server) error {
+	errs := make([]error, len(instances))
+
+	var wg sync.WaitGroup
+	for i, in := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = in.shutdown(in.context(ctx))
+		}()
+	}
+	wg.Wait()
+
+	if metrics != nil {
+		errs = append(errs, metrics.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// closeListeners closes the sockets of the instances listening so far when
+// serving can't be started.
+func closeListeners(instances []*instance) {
+	for _, in := range instances {
+		if in.listener != nil {
+			in.listener.Close()
 		}
-		return nil
-	case err := <-errChan:
-		return err
 	}
 }
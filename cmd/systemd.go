@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/containerd/log"
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// activatedListeners returns the sockets passed by systemd socket activation
+// through LISTEN_FDS for the addresses of the instances, in the same order, or
+// nil when the snapshotter was not socket activated. A single socket passed
+// for a single instance is used whatever its address.
+func activatedListeners(addrs []string) ([]net.Listener, error) {
+	listeners, err := activation.Listeners()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sockets passed by systemd: %w", err)
+	}
+
+	switch {
+	case len(listeners) == 0:
+		return nil, nil
+	case len(listeners) == 1 && len(addrs) == 1:
+		return listeners, nil
+	}
+
+	found := make([]net.Listener, len(addrs))
+	for _, l := range listeners {
+		i := slices.Index(addrs, l.Addr().String())
+		if i < 0 || found[i] != nil {
+			l.Close()
+			continue
+		}
+		found[i] = l
+	}
+
+	var errs []error
+	for i, l := range found {
+		if l == nil {
+			errs = append(errs, fmt.Errorf("none of the %d sockets passed by systemd listens on %q", len(listeners), addrs[i]))
+		}
+	}
+	if len(errs) > 0 {
+		for _, l := range found {
+			if l != nil {
+				l.Close()
+			}
+		}
+		return nil, errors.Join(errs...)
+	}
+	return found, nil
+}
+
+// notify sends a state to the systemd service manager. It does nothing when
+// the snapshotter is not run by systemd with Type=notify.
+func notify(ctx context.Context, state string) {
+	sent, err := daemon.SdNotify(false, state)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to notify systemd of %q", state)
+	} else if sent {
+		log.G(ctx).Debugf("notified systemd of %q", state)
+	}
+}
+
+// watchdog sends keep-alive notifications to systemd at half the watchdog
+// interval until the context is done. It does nothing when WatchdogSec is not
+// set for the service.
+func watchdog(ctx context.Context) {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to get systemd watchdog interval")
+		return
+	}
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			notify(ctx, daemon.SdNotifyWatchdog)
+		}
+	}
+}
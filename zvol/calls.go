@@ -0,0 +1,53 @@
+package zvol
+
+import (
+	"context"
+	"sync"
+)
+
+// detachedCalls runs calls that don't honour their context, like zfs commands
+// on a suspended pool, in the background, so the caller can give up when its
+// context is done. A call that is still running is joined by later calls with
+// the same key instead of being started again, so calls hanging on the pool
+// don't pile up. The zero value is ready to use.
+type detachedCalls struct {
+	mu    sync.Mutex
+	calls map[string]*detachedCall
+}
+
+type detachedCall struct {
+	done  chan struct{}
+	value any
+	err   error
+}
+
+// do runs fn unless a call with the key is still running, and returns the
+// result of the call, or the error of ctx when ctx is done first. fn gets a
+// context that is not canceled with ctx.
+func (c *detachedCalls) do(ctx context.Context, key string, fn func(ctx context.Context) (any, error)) (any, error) {
+	c.mu.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string]*detachedCall)
+	}
+	call, ok := c.calls[key]
+	if !ok {
+		call = &detachedCall{done: make(chan struct{})}
+		c.calls[key] = call
+		go func() {
+			call.value, call.err = fn(context.WithoutCancel(ctx))
+
+			c.mu.Lock()
+			delete(c.calls, key)
+			c.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,49 @@
+package zvol
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDetachedCalls(t *testing.T) {
+	var c detachedCalls
+
+	release := make(chan struct{})
+	var calls atomic.Int32
+	fn := func(ctx context.Context) (any, error) {
+		calls.Add(1)
+		<-release
+		return "done", nil
+	}
+
+	// Callers give up on a hanging call when their context is done, later
+	// callers join it instead of starting another call.
+	for range 2 {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if _, err := c.do(ctx, "a", fn); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("want deadline exceeded, got %v", err)
+		}
+		cancel()
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("want 1 call, got %d", n)
+	}
+
+	// Calls with other keys are not joined.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.do(ctx, "b", fn); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want deadline exceeded, got %v", err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("want 2 calls, got %d", n)
+	}
+
+	close(release)
+	if v, err := c.do(context.Background(), "a", fn); err != nil || v != "done" {
+		t.Errorf("want result of the call, got %v, %v", v, err)
+	}
+}
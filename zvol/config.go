@@ -3,7 +3,10 @@ package zvol
 import (
 	"errors"
 	"fmt"
+	"maps"
 	"os"
+	"slices"
+	"strconv"
 
 	"github.com/docker/go-units"
 	"github.com/pelletier/go-toml/v2"
@@ -20,11 +23,79 @@ type Config struct {
 	VolumeSize      string `toml:"volume_size"`
 	volumeSizeBytes uint64 `toml:"-"`
 
-	// Defines the file system to use for snapshot device mounts. Defaults to "ext4"
+	// ZFS quota of the dataset, limiting the space used by all volumes of the
+	// snapshotter. "none" removes the quota. Defaults to leaving the quota of
+	// the dataset unchanged
+	Quota         string `toml:"quota"`
+	quotaProperty string `toml:"-"`
+
+	// Defines the file system to use for snapshot device mounts, "ext4" or "xfs". Defaults to "ext4"
 	FileSystemType fsType `toml:"fs_type"`
+
+	// ZFS properties to set on created volumes and clones, e.g. compression.
+	// Properties that can only be set at creation, like volblocksize, are
+	// inherited by clones from their origin.
+	VolumeProperties map[string]string `toml:"volume_properties"`
+
+	// ZFS properties that can be set per snapshot with labels. No properties
+	// can be set through labels by default.
+	AllowedLabelProperties []string `toml:"allowed_label_properties"`
+
+	// Return mounts describing the raw block device of snapshots instead of a
+	// file system mount, for VM based runtimes. Can be overridden per snapshot
+	// with the block device label.
+	BlockDevice bool `toml:"block_device"`
+
+	// Defines how differences between the metadata store and the ZFS datasets
+	// are handled at startup, "none", "report" or "repair". Defaults to "report"
+	ReconcilePolicy reconcilePolicy `toml:"reconcile_policy"`
+
+	// Defines how ZFS datasets are managed, "cli" runs the zfs command line
+	// tools and "ioctl" talks to the ZFS kernel module directly. Defaults to "cli"
+	Backend backend `toml:"backend"`
+
+	// Clone snapshots without a parent from a formatted template volume per
+	// volume size and file system type instead of creating a file system for
+	// each of them
+	BaseTemplate bool `toml:"base_template"`
+
+	// Number of formatted empty volumes of volume_size and fs_type to keep
+	// ready for snapshots without a parent. Defaults to 0, disabling the warm pool
+	WarmPoolSize int `toml:"warm_pool_size"`
+
+	// Number of warm pool volumes formatted in parallel when refilling the
+	// warm pool. Defaults to 1
+	WarmPoolConcurrency int `toml:"warm_pool_concurrency"`
 }
 
-func (c *Config) parse() error {
+// TracingConfig configures exporting OpenTelemetry traces. The tracer
+// provider is global, so tracing is configured for the process rather than
+// per snapshotter.
+type TracingConfig struct {
+	// Defines where trace spans are exported to, "none" or "otlp". Empty
+	// disables tracing
+	Exporter tracingExporter `toml:"exporter"`
+
+	// Defines the OTLP transport, "grpc" or "http/protobuf". Empty uses "grpc"
+	Protocol otlpProtocol `toml:"protocol"`
+
+	// OTLP collector endpoint as host:port. Defaults to the
+	// OTEL_EXPORTER_OTLP_ENDPOINT environment variable or the default
+	// endpoint of the protocol on localhost
+	Endpoint string `toml:"endpoint"`
+
+	// Connect to the OTLP endpoint without TLS
+	Insecure bool `toml:"insecure"`
+
+	// Fraction of traces to sample, between 0 and 1. Defaults to 1, 0 only
+	// samples requests that are part of a sampled trace from containerd
+	SamplingRatio *float64 `toml:"sampling_ratio"`
+}
+
+// Parse applies the defaults of unset fields and parses the sizes of a config.
+// It must be called on a decoded config before it is validated, the configs
+// returned by NewConfig and NewConfigFromToml are parsed already.
+func (c *Config) Parse() error {
 	if c.VolumeSize == "" {
 		c.volumeSizeBytes = defaultVolumeSize
 	} else {
@@ -35,10 +106,33 @@ func (c *Config) parse() error {
 		c.volumeSizeBytes = uint64(volumeSize)
 	}
 
+	switch c.Quota {
+	case "", "none":
+		c.quotaProperty = c.Quota
+	default:
+		quota, err := units.RAMInBytes(c.Quota)
+		if err != nil {
+			return fmt.Errorf("failed to parse quota: '%s': %w", c.Quota, err)
+		}
+		c.quotaProperty = strconv.FormatInt(quota, 10)
+	}
+
 	if c.FileSystemType == "" {
 		c.FileSystemType = fsTypeExt4
 	}
 
+	if c.ReconcilePolicy == "" {
+		c.ReconcilePolicy = reconcilePolicyReport
+	}
+
+	if c.Backend == "" {
+		c.Backend = backendCLI
+	}
+
+	if c.WarmPoolConcurrency == 0 {
+		c.WarmPoolConcurrency = 1
+	}
+
 	return nil
 }
 
@@ -54,22 +148,75 @@ func (c *Config) Validate() error {
 	}
 
 	if c.FileSystemType != "" {
-		switch c.FileSystemType {
-		case fsTypeExt4:
-		default:
+		if !c.FileSystemType.supported() {
 			result = append(result, fmt.Errorf("unsupported filesystem type: %q", c.FileSystemType))
 		}
 	} else {
 		result = append(result, fmt.Errorf("fs_type is required"))
 	}
 
+	switch c.ReconcilePolicy {
+	case "", reconcilePolicyNone, reconcilePolicyReport, reconcilePolicyRepair:
+	default:
+		result = append(result, fmt.Errorf("unsupported reconcile policy: %q", c.ReconcilePolicy))
+	}
+
+	switch c.Backend {
+	case "", backendCLI, backendIoctl:
+	default:
+		result = append(result, fmt.Errorf("unsupported backend: %q", c.Backend))
+	}
+
+	if c.WarmPoolSize < 0 {
+		result = append(result, fmt.Errorf("warm_pool_size must not be negative: %d", c.WarmPoolSize))
+	}
+
+	if c.WarmPoolConcurrency < 0 {
+		result = append(result, fmt.Errorf("warm_pool_concurrency must not be negative: %d", c.WarmPoolConcurrency))
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.VolumeProperties)) {
+		if err := validateVolumeProperty(name); err != nil {
+			result = append(result, err)
+		}
+	}
+
+	for _, name := range c.AllowedLabelProperties {
+		if err := validateVolumeProperty(name); err != nil {
+			result = append(result, err)
+		}
+	}
+
+	return errors.Join(result...)
+}
+
+// Validate checks the tracing config.
+func (c *TracingConfig) Validate() error {
+	var result []error
+
+	switch c.Exporter {
+	case "", tracingExporterNone, tracingExporterOTLP:
+	default:
+		result = append(result, fmt.Errorf("unsupported tracing exporter: %q", c.Exporter))
+	}
+
+	switch c.Protocol {
+	case "", otlpProtocolGRPC, otlpProtocolHTTP:
+	default:
+		result = append(result, fmt.Errorf("unsupported OTLP protocol: %q", c.Protocol))
+	}
+
+	if ratio := c.SamplingRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+		result = append(result, fmt.Errorf("tracing sampling_ratio must be between 0 and 1: %v", *ratio))
+	}
+
 	return errors.Join(result...)
 }
 
 func NewConfig() (*Config, error) {
 	cfg := Config{}
 
-	if err := cfg.parse(); err != nil {
+	if err := cfg.Parse(); err != nil {
 		return nil, err
 	}
 
@@ -88,7 +235,7 @@ func NewConfigFromToml(path string) (*Config, error) {
 		return nil, fmt.Errorf("failed to unmarshal config TOML: %w", err)
 	}
 
-	if err := config.parse(); err != nil {
+	if err := config.Parse(); err != nil {
 		return nil, err
 	}
 
@@ -12,9 +12,10 @@ import (
 func TestNewConfigFromToml(t *testing.T) {
 	t.Run("valid config", func(t *testing.T) {
 		want := Config{
-			RootPath:   "/tmp",
-			Dataset:    "tank/snapshots",
-			VolumeSize: "50G",
+			RootPath:    "/tmp",
+			Dataset:     "tank/snapshots",
+			VolumeSize:  "50G",
+			BlockDevice: true,
 		}
 
 		file, err := os.CreateTemp("", "zvol-snapshotter-config-")
@@ -57,6 +58,23 @@ func TestNewConfigFromToml(t *testing.T) {
 		if got.FileSystemType != fsTypeExt4 {
 			t.Errorf("want config.FileSystemType: %s, got: %s", fsTypeExt4, got.FileSystemType)
 		}
+
+		if got.ReconcilePolicy != reconcilePolicyReport {
+			t.Errorf("want config.ReconcilePolicy: %s, got: %s", reconcilePolicyReport, got.ReconcilePolicy)
+		}
+
+		if got.BlockDevice != want.BlockDevice {
+			t.Errorf("want config.BlockDevice: %t, got: %t", want.BlockDevice, got.BlockDevice)
+		}
+
+		if got.Backend != backendCLI {
+			t.Errorf("want config.Backend: %s, got: %s", backendCLI, got.Backend)
+		}
+
+		if got.WarmPoolConcurrency != 1 {
+			t.Errorf("want config.WarmPoolConcurrency: %d, got: %d", 1, got.WarmPoolConcurrency)
+		}
+
 	})
 
 	t.Run("invalid path", func(t *testing.T) {
@@ -121,4 +139,144 @@ func TestConfigFieldValidation(t *testing.T) {
 			t.Errorf("want nil, get error: %s", err)
 		}
 	})
+
+	t.Run("xfs file system", func(t *testing.T) {
+		cfg := Config{
+			RootPath:       "/tmp",
+			Dataset:        "tank/snapshots",
+			FileSystemType: "xfs",
+		}
+
+		err := cfg.Validate()
+		if err != nil {
+			t.Errorf("want nil, get error: %s", err)
+		}
+	})
+
+	t.Run("volume properties", func(t *testing.T) {
+		cfg := Config{
+			RootPath:       "/tmp",
+			Dataset:        "tank/snapshots",
+			FileSystemType: "ext4",
+			VolumeProperties: map[string]string{
+				"compression":       "zstd",
+				"volblocksize":      "16K",
+				"com.example:owner": "ci",
+			},
+		}
+
+		err := cfg.Validate()
+		if err != nil {
+			t.Errorf("want nil, get error: %s", err)
+		}
+	})
+
+	t.Run("invalid volume properties", func(t *testing.T) {
+		cfg := Config{
+			RootPath:       "/tmp",
+			Dataset:        "tank/snapshots",
+			FileSystemType: "ext4",
+			VolumeProperties: map[string]string{
+				"volmode":         "dev",
+				"recordsize":      "1M",
+				"containerd:test": "x",
+			},
+		}
+
+		err := cfg.Validate()
+
+		multErr := err.(interface{ Unwrap() []error }).Unwrap()
+		if len(multErr) != 3 {
+			t.Errorf("want %d errors, got %d", 3, len(multErr))
+		}
+	})
+
+	t.Run("unsupported reconcile policy", func(t *testing.T) {
+		cfg := Config{
+			RootPath:        "/tmp",
+			Dataset:         "tank/snapshots",
+			FileSystemType:  "ext4",
+			ReconcilePolicy: "delete",
+		}
+
+		err := cfg.Validate()
+		if err == nil {
+			t.Errorf("want error, got nil")
+		}
+	})
+
+	t.Run("unsupported backend", func(t *testing.T) {
+		cfg := Config{
+			RootPath:       "/tmp",
+			Dataset:        "tank/snapshots",
+			FileSystemType: "ext4",
+			Backend:        "libzfs",
+		}
+
+		err := cfg.Validate()
+		if err == nil {
+			t.Errorf("want error, got nil")
+		}
+	})
+
+	t.Run("negative warm pool size", func(t *testing.T) {
+		cfg := Config{
+			RootPath:       "/tmp",
+			Dataset:        "tank/snapshots",
+			FileSystemType: "ext4",
+			WarmPoolSize:   -1,
+		}
+
+		err := cfg.Validate()
+		if err == nil {
+			t.Errorf("want error, got nil")
+		}
+	})
+
+	t.Run("unsupported file system", func(t *testing.T) {
+		cfg := Config{
+			RootPath:       "/tmp",
+			Dataset:        "tank/snapshots",
+			FileSystemType: "btrfs",
+		}
+
+		err := cfg.Validate()
+		if err == nil {
+			t.Errorf("want error, got nil")
+		}
+	})
+}
+
+func TestTracingConfigValidation(t *testing.T) {
+	t.Run("valid tracing config", func(t *testing.T) {
+		// A sampling ratio of 0 only samples requests that are part of a
+		// sampled trace.
+		ratio := 0.0
+		cfg := TracingConfig{
+			Exporter:      tracingExporterOTLP,
+			Protocol:      otlpProtocolHTTP,
+			SamplingRatio: &ratio,
+		}
+
+		err := cfg.Validate()
+		if err != nil {
+			t.Errorf("want nil, get error: %s", err)
+		}
+	})
+
+	t.Run("invalid tracing config", func(t *testing.T) {
+		ratio := 2.0
+		cfg := TracingConfig{
+			Exporter:      "jaeger",
+			Protocol:      "udp",
+			SamplingRatio: &ratio,
+		}
+
+		err := cfg.Validate()
+
+		multErr := err.(interface{ Unwrap() []error }).Unwrap()
+		if len(multErr) != 3 {
+			t.Errorf("want %d errors, got %d", 3, len(multErr))
+		}
+	})
 }
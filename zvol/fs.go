@@ -0,0 +1,184 @@
+package zvol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/log"
+)
+
+type fsType string
+
+const (
+	fsTypeExt4 fsType = "ext4"
+	fsTypeXfs  fsType = "xfs"
+)
+
+var errUnsupportedFsType = errors.New("file system not supported")
+
+func (fs fsType) supported() bool {
+	switch fs {
+	case fsTypeExt4, fsTypeXfs:
+		return true
+	default:
+		return false
+	}
+}
+
+func parseFsType(v string) (fsType, error) {
+	fs := fsType(v)
+	if !fs.supported() {
+		return "", fmt.Errorf("%w: %q", errUnsupportedFsType, v)
+	}
+	return fs, nil
+}
+
+// mkfs creates a filesystem on the given zfs volume
+func mkfs(ctx context.Context, fs fsType, path string) error {
+	command, args, err := mkfsCommand(fs, path)
+	if err != nil {
+		return err
+	}
+
+	out, err := runCommand(ctx, command, args...)
+	if err != nil {
+		return fmt.Errorf("%s failed to initialize %q: %s: %w", command, path, out, err)
+	}
+
+	log.G(ctx).Debugf("mkfs:\n%s", out)
+	return nil
+}
+
+// mkfsCommand returns the command and arguments creating a file system on the
+// given zfs volume.
+func mkfsCommand(fs fsType, path string) (command string, args []string, err error) {
+	switch fs {
+	case fsTypeExt4:
+		// ext4 options taken from device mapper.
+		// Explicitly disable lazy_itable_init and lazy_journal_init in order to enable lazy initialization.
+		command = "mkfs.ext4"
+		args = []string{
+			"-E",
+			"nodiscard,lazy_itable_init=0,lazy_journal_init=0",
+			path,
+		}
+	case fsTypeXfs:
+		// Don't discard blocks, a newly created zfs volume is already empty.
+		command = "mkfs.xfs"
+		args = []string{
+			"-K",
+			path,
+		}
+	default:
+		return "", nil, errUnsupportedFsType
+	}
+
+	return command, args, nil
+}
+
+// resizefs grows the file system on the given zfs volume to fill the volume.
+// The file system must not be mounted.
+func resizefs(ctx context.Context, fs fsType, path string) error {
+	switch fs {
+	case fsTypeExt4:
+		// resize2fs refuses to resize a file system that has not been checked
+		// since it was last mounted.
+		out, err := runCommand(ctx, "e2fsck", "-f", "-p", path)
+		if err != nil {
+			// Exit code 1 indicates file system errors were corrected.
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+				return fmt.Errorf("e2fsck failed to check %q: %s: %w", path, out, err)
+			}
+		}
+		log.G(ctx).Debugf("e2fsck:\n%s", out)
+
+		out, err = runCommand(ctx, "resize2fs", path)
+		if err != nil {
+			return fmt.Errorf("resize2fs failed to resize %q: %s: %w", path, out, err)
+		}
+		log.G(ctx).Debugf("resize2fs:\n%s", out)
+	case fsTypeXfs:
+		// XFS can only be grown while it is mounted.
+		mounts := []mount.Mount{
+			{
+				Type:    string(fs),
+				Source:  path,
+				Options: mountOptions(fs, false),
+			},
+		}
+		return withTempMount(ctx, mounts, func(root string) error {
+			out, err := runCommand(ctx, "xfs_growfs", root)
+			if err != nil {
+				return fmt.Errorf("xfs_growfs failed to resize %q: %s: %w", path, out, err)
+			}
+			log.G(ctx).Debugf("xfs_growfs:\n%s", out)
+			return nil
+		})
+	default:
+		return errUnsupportedFsType
+	}
+
+	return nil
+}
+
+// cleanupfs removes default directories created by mkfs that are not
+// expected by the container image.
+func cleanupfs(ctx context.Context, fs fsType, mounts []mount.Mount) error {
+	var dirs []string
+	switch fs {
+	case fsTypeExt4:
+		dirs = []string{"lost+found"}
+	case fsTypeXfs:
+		// mkfs.xfs does not create any directories.
+	default:
+		return errUnsupportedFsType
+	}
+
+	if len(dirs) == 0 {
+		return nil
+	}
+
+	return withTempMount(ctx, mounts, func(root string) error {
+		var errs []error
+		for _, dir := range dirs {
+			errs = append(errs, os.Remove(filepath.Join(root, dir)))
+		}
+		return errors.Join(errs...)
+	})
+}
+
+// mountOptions returns the options used to mount a snapshot device with the
+// given file system.
+func mountOptions(fs fsType, readonly bool) []string {
+	var options []string
+	if readonly {
+		options = append(options, "ro")
+	}
+
+	if fs == fsTypeXfs {
+		// Clones share the file system UUID of their origin. XFS refuses to
+		// mount a file system with a duplicate UUID unless told otherwise.
+		options = append(options, "nouuid")
+
+		// A clone of a volume that was not cleanly unmounted has a dirty log
+		// which can not be replayed on a read-only mount.
+		if readonly {
+			options = append(options, "norecovery")
+		}
+	}
+
+	return options
+}
+
+func runCommand(ctx context.Context, command string, args ...string) (string, error) {
+	log.G(ctx).Debugf("%s %s", command, strings.Join(args, " "))
+	o, err := exec.CommandContext(ctx, command, args...).CombinedOutput()
+	return string(o), err
+}
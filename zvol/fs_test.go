@@ -0,0 +1,43 @@
+package zvol
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestMountOptions(t *testing.T) {
+	tests := []struct {
+		fs       fsType
+		readonly bool
+		want     []string
+	}{
+		{fs: fsTypeExt4, readonly: false, want: nil},
+		{fs: fsTypeExt4, readonly: true, want: []string{"ro"}},
+		{fs: fsTypeXfs, readonly: false, want: []string{"nouuid"}},
+		{fs: fsTypeXfs, readonly: true, want: []string{"ro", "nouuid", "norecovery"}},
+	}
+
+	for _, tc := range tests {
+		got := mountOptions(tc.fs, tc.readonly)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("mountOptions(%s, %t): want %v, got %v", tc.fs, tc.readonly, tc.want, got)
+		}
+	}
+}
+
+func TestParseFsType(t *testing.T) {
+	for _, v := range []string{"ext4", "xfs"} {
+		fs, err := parseFsType(v)
+		if err != nil {
+			t.Errorf("want nil, got error: %s", err)
+		}
+		if string(fs) != v {
+			t.Errorf("want %s, got %s", v, fs)
+		}
+	}
+
+	if _, err := parseFsType("btrfs"); !errors.Is(err, errUnsupportedFsType) {
+		t.Errorf("want: %s, got: %v", errUnsupportedFsType, err)
+	}
+}
@@ -0,0 +1,59 @@
+package zvol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+)
+
+// unhealthyPoolStates are the pool states in which volumes can't be read or
+// written.
+var unhealthyPoolStates = []string{"FAULTED", "SUSPENDED", "UNAVAIL"}
+
+// errStopWalk stops walking the snapshots of the metadata store.
+var errStopWalk = errors.New("stop walk")
+
+// Check reports whether the snapshotter can serve requests: the pool of the
+// dataset is not faulted or suspended, the dataset of the snapshotter exists
+// and the metadata store can be read. The pool is checked first, as the zfs
+// command and the metadata store hang on a suspended pool and don't honour
+// ctx. They are read in the background and the check fails when ctx is done.
+func (s *snapshotter) Check(ctx context.Context) error {
+	pool := poolName(s.dataset.Name)
+	health, err := s.volumes.PoolHealth(ctx, pool)
+	if err != nil {
+		return err
+	}
+	for _, state := range unhealthyPoolStates {
+		if health == state {
+			return fmt.Errorf("pool %s is %s", pool, health)
+		}
+	}
+
+	var errs []error
+
+	if _, err := s.getDataset(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to get dataset %s: %w", s.dataset.Name, err))
+	}
+
+	if _, err := s.calls.do(ctx, "read metadata", func(ctx context.Context) (any, error) {
+		err := s.store.WithTransaction(ctx, false, func(ctx context.Context) error {
+			return storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+				return errStopWalk
+			})
+		})
+		// The buckets are created with the first snapshot.
+		if errors.Is(err, errStopWalk) || errdefs.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}); err != nil {
+		errs = append(errs, fmt.Errorf("failed to read metadata store: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,88 @@
+package zvol
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSnapshotterCheck(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("healthy", func(t *testing.T) {
+		s, volumes := newTestSnapshotter(t, &Config{})
+
+		for _, health := range []string{"ONLINE", "DEGRADED"} {
+			volumes.health = health
+			if err := s.Check(ctx); err != nil {
+				t.Errorf("want nil for %s pool, got %v", health, err)
+			}
+		}
+	})
+
+	t.Run("unhealthy pool", func(t *testing.T) {
+		s, volumes := newTestSnapshotter(t, &Config{})
+
+		for _, health := range []string{"FAULTED", "SUSPENDED", "UNAVAIL"} {
+			volumes.health = health
+			if err := s.Check(ctx); err == nil {
+				t.Errorf("want error for %s pool, got nil", health)
+			}
+		}
+	})
+
+	t.Run("missing dataset", func(t *testing.T) {
+		s, volumes := newTestSnapshotter(t, &Config{})
+
+		volumes.mu.Lock()
+		delete(volumes.datasets, testDataset)
+		volumes.mu.Unlock()
+
+		if err := s.Check(ctx); err == nil {
+			t.Error("want error, got nil")
+		}
+	})
+
+	t.Run("hanging dataset", func(t *testing.T) {
+		s, volumes := newTestSnapshotter(t, &Config{})
+
+		release := make(chan struct{})
+		defer close(release)
+		var gets atomic.Int32
+		volumes.getDataset = func(name string) error {
+			gets.Add(1)
+			<-release
+			return nil
+		}
+
+		// A suspended pool is reported without waiting for the dataset.
+		volumes.health = "SUSPENDED"
+		if err := s.Check(ctx); err == nil {
+			t.Error("want error for SUSPENDED pool, got nil")
+		}
+		if n := gets.Load(); n != 0 {
+			t.Errorf("want dataset not to be read, got %d reads", n)
+		}
+
+		volumes.health = ""
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		if err := s.Check(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("want deadline exceeded, got %v", err)
+		}
+	})
+
+	t.Run("closed metadata store", func(t *testing.T) {
+		s, _ := newTestSnapshotter(t, &Config{})
+
+		if err := s.store.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Check(ctx); err == nil {
+			t.Error("want error, got nil")
+		}
+	})
+}
@@ -0,0 +1,230 @@
+package zvol
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// instrumentedSnapshotter records the duration and errors of snapshotter
+// operations and traces them.
+type instrumentedSnapshotter struct {
+	*snapshotter
+	collector *snapshotterCollector
+}
+
+// newInstrumentedSnapshotter returns the instrumented snapshotter and
+// registers the collector of its snapshot and dataset metrics. Registering
+// fails when a snapshotter of the same dataset is already registered.
+func newInstrumentedSnapshotter(s *snapshotter) (*instrumentedSnapshotter, error) {
+	collector := newSnapshotterCollector(s)
+	if err := prometheus.Register(collector); err != nil {
+		return nil, fmt.Errorf("failed to register metrics of dataset %s: %w", s.dataset.Name, err)
+	}
+
+	return &instrumentedSnapshotter{snapshotter: s, collector: collector}, nil
+}
+
+// start starts the span of an operation. The returned function records the
+// duration and error of the operation and ends the span.
+func (s *instrumentedSnapshotter) start(ctx context.Context, operation, key string) (context.Context, func(*error)) {
+	start := time.Now()
+	ctx, span := startSpan(ctx, "snapshotter."+operation,
+		attribute.String("zvol.dataset", s.dataset.Name),
+		attribute.String("zvol.key", key),
+	)
+	return ctx, func(err *error) {
+		operationDuration.WithLabelValues(s.dataset.Name, operation).Observe(time.Since(start).Seconds())
+		if *err != nil {
+			operationErrors.WithLabelValues(s.dataset.Name, operation).Inc()
+		}
+		endSpan(span, *err)
+	}
+}
+
+func (s *instrumentedSnapshotter) Stat(ctx context.Context, key string) (_ snapshots.Info, err error) {
+	ctx, done := s.start(ctx, "stat", key)
+	defer done(&err)
+	return s.snapshotter.Stat(ctx, key)
+}
+
+func (s *instrumentedSnapshotter) Usage(ctx context.Context, key string) (_ snapshots.Usage, err error) {
+	ctx, done := s.start(ctx, "usage", key)
+	defer done(&err)
+	return s.snapshotter.Usage(ctx, key)
+}
+
+func (s *instrumentedSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) (_ []mount.Mount, err error) {
+	ctx, done := s.start(ctx, "prepare", key)
+	defer done(&err)
+	return s.snapshotter.Prepare(ctx, key, parent, opts...)
+}
+
+func (s *instrumentedSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) (_ []mount.Mount, err error) {
+	ctx, done := s.start(ctx, "view", key)
+	defer done(&err)
+	return s.snapshotter.View(ctx, key, parent, opts...)
+}
+
+func (s *instrumentedSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) (err error) {
+	ctx, done := s.start(ctx, "commit", key)
+	defer done(&err)
+	return s.snapshotter.Commit(ctx, name, key, opts...)
+}
+
+func (s *instrumentedSnapshotter) Remove(ctx context.Context, key string) (err error) {
+	ctx, done := s.start(ctx, "remove", key)
+	defer done(&err)
+	return s.snapshotter.Remove(ctx, key)
+}
+
+func (s *instrumentedSnapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, filters ...string) (err error) {
+	ctx, done := s.start(ctx, "walk", "")
+	defer done(&err)
+	return s.snapshotter.Walk(ctx, fn, filters...)
+}
+
+// Close unregisters the metrics collector before closing the snapshotter.
+func (s *instrumentedSnapshotter) Close() error {
+	if s.collector != nil {
+		prometheus.Unregister(s.collector)
+	}
+	return s.snapshotter.Close()
+}
+
+// instrumentedVolumeManager records the duration of ZFS operations and file
+// system creation and traces them.
+type instrumentedVolumeManager struct {
+	volumeManager
+	backend backend
+}
+
+// start starts the span of a ZFS operation. The returned function records the
+// duration and error of the operation and ends the span.
+func (m *instrumentedVolumeManager) start(ctx context.Context, operation, name string) (context.Context, func(*error)) {
+	start := time.Now()
+	ctx, span := startSpan(ctx, "zfs."+operation,
+		attribute.String("zfs.backend", string(m.backend)),
+		attribute.String("zfs.dataset", name),
+	)
+	return ctx, func(err *error) {
+		zfsDuration.WithLabelValues(string(m.backend), operation).Observe(time.Since(start).Seconds())
+		endSpan(span, *err)
+	}
+}
+
+func (m *instrumentedVolumeManager) Get(ctx context.Context, name string) (_ *dataset, err error) {
+	ctx, done := m.start(ctx, "get", name)
+	defer done(&err)
+	return m.volumeManager.Get(ctx, name)
+}
+
+func (m *instrumentedVolumeManager) Children(ctx context.Context, name string, depth uint64) (_ []*dataset, err error) {
+	ctx, done := m.start(ctx, "children", name)
+	defer done(&err)
+	return m.volumeManager.Children(ctx, name, depth)
+}
+
+func (m *instrumentedVolumeManager) CreateVolume(ctx context.Context, name string, size uint64, properties map[string]string) (_ *dataset, err error) {
+	ctx, done := m.start(ctx, "create_volume", name)
+	defer done(&err)
+	return m.volumeManager.CreateVolume(ctx, name, size, properties)
+}
+
+func (m *instrumentedVolumeManager) CheckVolumeProperties(ctx context.Context, parent string, size uint64, properties map[string]string) (err error) {
+	ctx, done := m.start(ctx, "check_volume_properties", parent)
+	defer done(&err)
+	return m.volumeManager.CheckVolumeProperties(ctx, parent, size, properties)
+}
+
+func (m *instrumentedVolumeManager) Clone(ctx context.Context, snapshot, name string, properties map[string]string) (_ *dataset, err error) {
+	ctx, done := m.start(ctx, "clone", name)
+	defer done(&err)
+	return m.volumeManager.Clone(ctx, snapshot, name, properties)
+}
+
+func (m *instrumentedVolumeManager) Snapshot(ctx context.Context, volume, name string) (_ *dataset, err error) {
+	ctx, done := m.start(ctx, "snapshot", volume)
+	defer done(&err)
+	return m.volumeManager.Snapshot(ctx, volume, name)
+}
+
+func (m *instrumentedVolumeManager) Commit(ctx context.Context, volume, name string, properties map[string]string) (_ *dataset, err error) {
+	ctx, done := m.start(ctx, "commit", volume)
+	defer done(&err)
+	return m.volumeManager.Commit(ctx, volume, name, properties)
+}
+
+func (m *instrumentedVolumeManager) Rename(ctx context.Context, name, newName string) (err error) {
+	ctx, done := m.start(ctx, "rename", name)
+	defer done(&err)
+	return m.volumeManager.Rename(ctx, name, newName)
+}
+
+func (m *instrumentedVolumeManager) Destroy(ctx context.Context, name string, flags destroyFlag) (err error) {
+	ctx, done := m.start(ctx, "destroy", name)
+	defer done(&err)
+	return m.volumeManager.Destroy(ctx, name, flags)
+}
+
+func (m *instrumentedVolumeManager) SetProperties(ctx context.Context, name string, properties map[string]string) (err error) {
+	ctx, done := m.start(ctx, "set_properties", name)
+	defer done(&err)
+	return m.volumeManager.SetProperties(ctx, name, properties)
+}
+
+func (m *instrumentedVolumeManager) GetProperty(ctx context.Context, name, property string) (_ string, err error) {
+	ctx, done := m.start(ctx, "get_property", name)
+	defer done(&err)
+	return m.volumeManager.GetProperty(ctx, name, property)
+}
+
+func (m *instrumentedVolumeManager) ListProperties(ctx context.Context, name string, properties ...string) (_ map[string]map[string]string, err error) {
+	ctx, done := m.start(ctx, "list_properties", name)
+	defer done(&err)
+	return m.volumeManager.ListProperties(ctx, name, properties...)
+}
+
+func (m *instrumentedVolumeManager) PoolHealth(ctx context.Context, pool string) (_ string, err error) {
+	ctx, done := m.start(ctx, "pool_health", pool)
+	defer done(&err)
+	return m.volumeManager.PoolHealth(ctx, pool)
+}
+
+func (m *instrumentedVolumeManager) Mkfs(ctx context.Context, fs fsType, device string) (err error) {
+	start := time.Now()
+	ctx, span := startSpan(ctx, "mkfs",
+		attribute.String("fs.type", string(fs)),
+		attribute.String("fs.device", device),
+	)
+	defer func() {
+		mkfsDuration.WithLabelValues(string(fs)).Observe(time.Since(start).Seconds())
+		endSpan(span, err)
+	}()
+	return m.volumeManager.Mkfs(ctx, fs, device)
+}
+
+func (m *instrumentedVolumeManager) Resizefs(ctx context.Context, fs fsType, device string) (err error) {
+	ctx, span := startSpan(ctx, "resizefs",
+		attribute.String("fs.type", string(fs)),
+		attribute.String("fs.device", device),
+	)
+	defer func() {
+		endSpan(span, err)
+	}()
+	return m.volumeManager.Resizefs(ctx, fs, device)
+}
+
+// Close closes the wrapped volume manager.
+func (m *instrumentedVolumeManager) Close() error {
+	if c, ok := m.volumeManager.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package zvol
+
+import "sync"
+
+// keyLocks serializes operations on the same snapshot key while operations on
+// different keys run in parallel. The zero value is ready to use.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	// waiters counts the holder and the goroutines waiting for the lock.
+	waiters int
+}
+
+// lock locks the key, waiting until it is unlocked if it is already locked.
+func (l *keyLocks) lock(key string) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*keyLock)
+	}
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.waiters++
+	l.mu.Unlock()
+
+	kl.Lock()
+}
+
+// unlock unlocks the key.
+func (l *keyLocks) unlock(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	kl, ok := l.locks[key]
+	if !ok {
+		panic("zvol: unlock of unlocked key " + key)
+	}
+	kl.waiters--
+	if kl.waiters == 0 {
+		delete(l.locks, key)
+	}
+	kl.Unlock()
+}
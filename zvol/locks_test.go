@@ -0,0 +1,35 @@
+package zvol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyLocks(t *testing.T) {
+	var l keyLocks
+
+	l.lock("a")
+	// Other keys can be locked while a key is locked.
+	l.lock("b")
+	l.unlock("b")
+
+	locked := make(chan struct{})
+	go func() {
+		l.lock("a")
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("expected lock of locked key to wait")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	l.unlock("a")
+	<-locked
+	l.unlock("a")
+
+	if len(l.locks) != 0 {
+		t.Errorf("want no locks, got %d", len(l.locks))
+	}
+}
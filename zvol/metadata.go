@@ -0,0 +1,404 @@
+package zvol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/metadata/boltutil"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ZFS user properties recording the snapshot metadata on the volume of each
+// snapshot. Together with the snapshot ID, which is the name of the volume,
+// they hold everything needed to rebuild the metadata store.
+const (
+	zfsMetadataKeyProperty     = "containerd:meta.key"
+	zfsMetadataKindProperty    = "containerd:meta.kind"
+	zfsMetadataParentProperty  = "containerd:meta.parent"
+	zfsMetadataCreatedProperty = "containerd:meta.created"
+	zfsMetadataUpdatedProperty = "containerd:meta.updated"
+	zfsMetadataLabelsProperty  = "containerd:meta.labels"
+
+	// zfsPropertyMaxValueLength is the maximum length of a zfs user property value.
+	zfsPropertyMaxValueLength = 8192
+)
+
+var zfsMetadataProperties = []string{
+	zfsMetadataKeyProperty,
+	zfsMetadataKindProperty,
+	zfsMetadataParentProperty,
+	zfsMetadataCreatedProperty,
+	zfsMetadataUpdatedProperty,
+	zfsMetadataLabelsProperty,
+	"used",
+}
+
+// Bucket keys of the snapshots bucket of the containerd snapshot metadata
+// store, whose sequence assigns the snapshot IDs.
+var (
+	bucketKeyStorageVersion = []byte("v1")
+	bucketKeySnapshot       = []byte("snapshots")
+)
+
+// bucketKeyReserved is a bucket of the snapshotter next to the containerd
+// snapshot metadata. It records the IDs of snapshots reserved in the metadata
+// store whose volume is still being created.
+var bucketKeyReserved = []byte("zvol.reserved")
+
+// withBoltTransaction runs fn in a storage transaction of the metadata store,
+// like MetaStore.WithTransaction, and passes it the bolt transaction to access
+// the buckets of the snapshotter.
+func withBoltTransaction(ctx context.Context, ms *storage.MetaStore, writable bool, fn func(ctx context.Context, tx *bolt.Tx) error) error {
+	tctx, t, err := ms.TransactionContext(ctx, writable)
+	if err != nil {
+		return err
+	}
+	tx, ok := t.(*bolt.Tx)
+	if !ok {
+		t.Rollback()
+		return fmt.Errorf("unexpected metadata store transaction %T", t)
+	}
+
+	if err := fn(tctx, tx); err != nil || !writable {
+		return errors.Join(err, t.Rollback())
+	}
+	return t.Commit()
+}
+
+// markReserved records that the volume of the snapshot with the ID is being
+// created.
+func markReserved(tx *bolt.Tx, id string) error {
+	bkt, err := tx.CreateBucketIfNotExists(bucketKeyReserved)
+	if err != nil {
+		return err
+	}
+	return bkt.Put([]byte(id), []byte{})
+}
+
+// clearReserved removes the reservation of the snapshot with the ID once its
+// volume was created or its metadata removed.
+func clearReserved(tx *bolt.Tx, id string) error {
+	bkt := tx.Bucket(bucketKeyReserved)
+	if bkt == nil {
+		return nil
+	}
+	return bkt.Delete([]byte(id))
+}
+
+// reservedIDs returns the IDs of the snapshots whose volume was being created.
+func reservedIDs(tx *bolt.Tx) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	bkt := tx.Bucket(bucketKeyReserved)
+	if bkt == nil {
+		return ids, nil
+	}
+	err := bkt.ForEach(func(k, _ []byte) error {
+		ids[string(k)] = true
+		return nil
+	})
+	return ids, err
+}
+
+// getZfsMetadataProperties returns the zfs user properties recording the
+// snapshot metadata.
+func getZfsMetadataProperties(ctx context.Context, info snapshots.Info) (map[string]string, error) {
+	props := map[string]string{
+		zfsMetadataKeyProperty:     info.Name,
+		zfsMetadataKindProperty:    strings.ToLower(info.Kind.String()),
+		zfsMetadataCreatedProperty: info.Created.UTC().Format(time.RFC3339Nano),
+		zfsMetadataUpdatedProperty: info.Updated.UTC().Format(time.RFC3339Nano),
+	}
+
+	if info.Parent != "" {
+		props[zfsMetadataParentProperty] = info.Parent
+	}
+
+	labels, err := json.Marshal(info.Labels)
+	if err != nil {
+		return nil, err
+	}
+	if len(labels) > zfsPropertyMaxValueLength {
+		log.G(ctx).Warnf("labels of snapshot %q exceed the maximum zfs property length, they can not be recovered", info.Name)
+	} else {
+		props[zfsMetadataLabelsProperty] = string(labels)
+	}
+
+	return props, nil
+}
+
+// recoveredSnapshot is a snapshot recovered from zfs user properties.
+type recoveredSnapshot struct {
+	id    uint64
+	info  snapshots.Info
+	usage snapshots.Usage
+}
+
+// parseZfsMetadataProperties recovers a snapshot from the zfs user properties
+// of its volume.
+func parseZfsMetadataProperties(id uint64, props map[string]string) (recoveredSnapshot, error) {
+	snap := recoveredSnapshot{id: id}
+
+	snap.info.Name = props[zfsMetadataKeyProperty]
+	if snap.info.Name == "" {
+		return snap, errors.New("no snapshot metadata recorded")
+	}
+
+	kind := props[zfsMetadataKindProperty]
+	snap.info.Kind = snapshots.ParseKind(kind)
+	if snap.info.Kind == snapshots.KindUnknown {
+		return snap, fmt.Errorf("invalid snapshot kind: %q", kind)
+	}
+
+	snap.info.Parent = props[zfsMetadataParentProperty]
+
+	var err error
+	snap.info.Created, err = time.Parse(time.RFC3339Nano, props[zfsMetadataCreatedProperty])
+	if err != nil {
+		return snap, fmt.Errorf("invalid created time: %w", err)
+	}
+	snap.info.Updated, err = time.Parse(time.RFC3339Nano, props[zfsMetadataUpdatedProperty])
+	if err != nil {
+		return snap, fmt.Errorf("invalid updated time: %w", err)
+	}
+
+	if labels, ok := props[zfsMetadataLabelsProperty]; ok {
+		if err := json.Unmarshal([]byte(labels), &snap.info.Labels); err != nil {
+			return snap, fmt.Errorf("invalid labels: %w", err)
+		}
+	}
+
+	if snap.info.Kind == snapshots.KindCommitted {
+		used, err := strconv.ParseInt(props["used"], 10, 64)
+		if err != nil {
+			return snap, fmt.Errorf("invalid used size: %w", err)
+		}
+		snap.usage = snapshots.Usage{
+			Size:   used,
+			Inodes: -1,
+		}
+	}
+
+	return snap, nil
+}
+
+// readZfsMetadataProperties returns the metadata properties of all volumes
+// under the dataset by snapshot ID.
+func readZfsMetadataProperties(ctx context.Context, volumes volumeManager, dataset string) (map[uint64]map[string]string, error) {
+	props, err := volumes.ListProperties(ctx, dataset, zfsMetadataProperties...)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[uint64]map[string]string, len(props))
+	for name, p := range props {
+		id, err := strconv.ParseUint(path.Base(name), 10, 64)
+		if err != nil || path.Dir(name) != dataset {
+			continue
+		}
+		ids[id] = p
+	}
+
+	return ids, nil
+}
+
+// RebuildMetadata rebuilds the metadata store from the snapshot metadata
+// recorded as zfs user properties on the volumes of the snapshotter. An
+// existing metadata store is kept as a backup. The snapshotter must not be
+// running while the metadata is rebuilt, a metadata store in use is refused.
+func RebuildMetadata(ctx context.Context, config *Config) error {
+	return rebuildMetadata(ctx, config, &zfsVolumeManager{})
+}
+
+func rebuildMetadata(ctx context.Context, config *Config, vm volumeManager) error {
+	if err := config.Parse(); err != nil {
+		return err
+	}
+
+	dataset, err := vm.Get(ctx, config.Dataset)
+	if err != nil {
+		return err
+	}
+
+	volumes, err := readZfsMetadataProperties(ctx, vm, dataset.Name)
+	if err != nil {
+		return err
+	}
+
+	snaps := recoverSnapshots(ctx, volumes)
+
+	if err := os.MkdirAll(config.RootPath, 0750); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to create root directory: %s: %w", config.RootPath, err)
+	}
+
+	dbFile := filepath.Join(config.RootPath, "metadata.db")
+	if _, err := os.Stat(dbFile); err == nil {
+		if err := backupMetadata(ctx, dbFile); err != nil {
+			return err
+		}
+	}
+
+	ms, err := storage.NewMetaStore(dbFile)
+	if err != nil {
+		return err
+	}
+	defer ms.Close()
+
+	// New snapshots must not reuse the ID of any existing volume.
+	var sequence uint64
+	if len(volumes) > 0 {
+		sequence = slices.Max(slices.Collect(maps.Keys(volumes)))
+	}
+
+	if err := withBoltTransaction(ctx, ms, true, func(ctx context.Context, tx *bolt.Tx) error {
+		return writeSnapshots(ctx, tx, snaps, sequence)
+	}); err != nil {
+		return fmt.Errorf("failed to write metadata store: %w", err)
+	}
+
+	log.G(ctx).Infof("rebuilt metadata of %d snapshots", len(snaps))
+	return nil
+}
+
+// backupMetadata moves an existing metadata store out of the way. A running
+// snapshotter holds a lock on the store and would keep writing to the backup,
+// so a locked store is refused. A store that can't be opened, e.g. because it
+// is corrupted, is backed up as is.
+func backupMetadata(ctx context.Context, dbFile string) error {
+	db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return fmt.Errorf("metadata store %s is in use, stop the snapshotter first: %w", dbFile, errdefs.ErrFailedPrecondition)
+	} else if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to open existing metadata store")
+	} else {
+		// The lock is held until the store is moved, so a snapshotter
+		// starting meanwhile doesn't open it.
+		defer db.Close()
+	}
+
+	backup := fmt.Sprintf("%s.%d.bak", dbFile, time.Now().Unix())
+	if err := os.Rename(dbFile, backup); err != nil {
+		return fmt.Errorf("failed to back up metadata store: %w", err)
+	}
+	log.G(ctx).Infof("moved existing metadata store to %s", backup)
+	return nil
+}
+
+// recoverSnapshots recovers the snapshots from the volume properties. Volumes
+// without valid metadata and snapshots whose parent can not be recovered are
+// skipped.
+func recoverSnapshots(ctx context.Context, volumes map[uint64]map[string]string) []recoveredSnapshot {
+	var (
+		snaps     []recoveredSnapshot
+		committed = make(map[string]bool)
+		keys      = make(map[string]bool)
+	)
+
+	// Parents always have a lower ID than their children.
+	for _, id := range slices.Sorted(maps.Keys(volumes)) {
+		// The storage package assigns IDs starting at 1.
+		if id == 0 {
+			log.G(ctx).Warn("skipping volume 0, not a snapshot ID")
+			continue
+		}
+
+		snap, err := parseZfsMetadataProperties(id, volumes[id])
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("skipping volume %d", id)
+			continue
+		}
+
+		if keys[snap.info.Name] {
+			log.G(ctx).Warnf("skipping volume %d, duplicate snapshot %q", id, snap.info.Name)
+			continue
+		}
+
+		if snap.info.Parent != "" && !committed[snap.info.Parent] {
+			log.G(ctx).Warnf("skipping volume %d, parent %q of snapshot %q not recovered", id, snap.info.Parent, snap.info.Name)
+			continue
+		}
+
+		keys[snap.info.Name] = true
+		if snap.info.Kind == snapshots.KindCommitted {
+			committed[snap.info.Name] = true
+		}
+		snaps = append(snaps, snap)
+	}
+
+	return snaps
+}
+
+// writeSnapshots writes the snapshots to the metadata store with the
+// containerd snapshot storage package, in the storage transaction of ctx and
+// tx. Snapshots must be ordered by ID. Each snapshot keeps the ID of its
+// volume by setting the sequence of the snapshots bucket before it is
+// created, and its recorded timestamps are restored afterwards, as the storage
+// package sets them to the current time. New snapshots will get IDs after the
+// given sequence.
+func writeSnapshots(ctx context.Context, tx *bolt.Tx, snaps []recoveredSnapshot, sequence uint64) error {
+	vbkt, err := tx.CreateBucketIfNotExists(bucketKeyStorageVersion)
+	if err != nil {
+		return err
+	}
+	bkt, err := vbkt.CreateBucketIfNotExists(bucketKeySnapshot)
+	if err != nil {
+		return err
+	}
+
+	for _, snap := range snaps {
+		if err := bkt.SetSequence(snap.id - 1); err != nil {
+			return err
+		}
+
+		id, err := createRecoveredSnapshot(ctx, snap)
+		if err != nil {
+			return fmt.Errorf("snapshot %q: %w", snap.info.Name, err)
+		}
+		if id != strconv.FormatUint(snap.id, 10) {
+			return fmt.Errorf("snapshot %q: got ID %s instead of the volume ID %d", snap.info.Name, id, snap.id)
+		}
+
+		sbkt := bkt.Bucket([]byte(snap.info.Name))
+		if sbkt == nil {
+			return fmt.Errorf("snapshot %q: bucket not found", snap.info.Name)
+		}
+		if err := boltutil.WriteTimestamps(sbkt, snap.info.Created, snap.info.Updated); err != nil {
+			return err
+		}
+	}
+
+	return bkt.SetSequence(sequence)
+}
+
+// createRecoveredSnapshot creates a recovered snapshot in the metadata store
+// and returns its ID. Committed snapshots can only be created by committing
+// an active snapshot, which takes over its ID.
+func createRecoveredSnapshot(ctx context.Context, snap recoveredSnapshot) (string, error) {
+	opts := []snapshots.Opt{snapshots.WithLabels(snap.info.Labels)}
+
+	if snap.info.Kind != snapshots.KindCommitted {
+		s, err := storage.CreateSnapshot(ctx, snap.info.Kind, snap.info.Name, snap.info.Parent, opts...)
+		return s.ID, err
+	}
+
+	// The key of the intermediate active snapshot can't clash with a
+	// snapshot key from containerd.
+	active := fmt.Sprintf("\x00rebuild-%d", snap.id)
+	if _, err := storage.CreateSnapshot(ctx, snapshots.KindActive, active, snap.info.Parent); err != nil {
+		return "", err
+	}
+	return storage.CommitActive(ctx, active, snap.info.Name, snap.usage, opts...)
+}
@@ -0,0 +1,181 @@
+package zvol
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRecoverSnapshots(t *testing.T) {
+	created := time.Date(2025, 1, 2, 3, 4, 5, 6, time.UTC)
+	props := func(key, kind, parent string) map[string]string {
+		p := map[string]string{
+			zfsMetadataKeyProperty:     key,
+			zfsMetadataKindProperty:    kind,
+			zfsMetadataCreatedProperty: created.Format(time.RFC3339Nano),
+			zfsMetadataUpdatedProperty: created.Format(time.RFC3339Nano),
+			zfsMetadataLabelsProperty:  `{"containerd.io/snapshot/zvol/size":"1073741824"}`,
+			"used":                     "4096",
+		}
+		if parent != "" {
+			p[zfsMetadataParentProperty] = parent
+		}
+		return p
+	}
+
+	volumes := map[uint64]map[string]string{
+		1: props("base", "committed", ""),
+		3: props("layer", "committed", "base"),
+		4: props("container", "active", "layer"),
+		5: props("view", "view", "missing"),
+		7: {"used": "4096"},
+	}
+
+	snaps := recoverSnapshots(context.Background(), volumes)
+
+	var keys []string
+	for _, snap := range snaps {
+		keys = append(keys, snap.info.Name)
+	}
+	if want := []string{"base", "layer", "container"}; !slices.Equal(keys, want) {
+		t.Fatalf("want snapshots %v, got %v", want, keys)
+	}
+
+	ms, err := storage.NewMetaStore(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+
+	tctx, tx, err := ms.TransactionContext(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSnapshots(tctx, tx.(*bolt.Tx), snaps, 7); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	err = ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		id, info, usage, err := storage.GetInfo(ctx, "layer")
+		if err != nil {
+			return err
+		}
+		if id != "3" || info.Kind != snapshots.KindCommitted || info.Parent != "base" {
+			t.Errorf("unexpected snapshot %s: %+v", id, info)
+		}
+		if !info.Created.Equal(created) {
+			t.Errorf("want created %s, got %s", created, info.Created)
+		}
+		if want := map[string]string{LabelVolumeSize: "1073741824"}; !maps.Equal(info.Labels, want) {
+			t.Errorf("want labels %v, got %v", want, info.Labels)
+		}
+		if usage.Size != 4096 {
+			t.Errorf("want usage 4096, got %d", usage.Size)
+		}
+
+		snap, err := storage.GetSnapshot(ctx, "container")
+		if err != nil {
+			return err
+		}
+		if want := []string{"3", "1"}; !slices.Equal(snap.ParentIDs, want) {
+			t.Errorf("want parent IDs %v, got %v", want, snap.ParentIDs)
+		}
+
+		if _, _, err := storage.Remove(ctx, "layer"); err == nil {
+			t.Errorf("want error removing snapshot with child, got nil")
+		}
+
+		snap, err = storage.CreateSnapshot(ctx, snapshots.KindActive, "new", "layer")
+		if err != nil {
+			return err
+		}
+		if snap.ID != "8" {
+			t.Errorf("want new snapshot ID 8, got %s", snap.ID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebuildMetadata(t *testing.T) {
+	ctx := context.Background()
+	s, volumes := newTestSnapshotter(t, &Config{})
+
+	if _, err := s.Prepare(ctx, "base-active", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit(ctx, "base", "base-active", snapshots.WithLabels(map[string]string{"key": "value"})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Prepare(ctx, "container", "base"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	config := *s.config
+	if err := rebuildMetadata(ctx, &config, volumes); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newSnapshotter(ctx, &config, volumes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	info, err := s.Stat(ctx, "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Kind != snapshots.KindCommitted || info.Labels["key"] != "value" {
+		t.Errorf("unexpected snapshot: %+v", info)
+	}
+
+	info, err = s.Stat(ctx, "container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Kind != snapshots.KindActive || info.Parent != "base" {
+		t.Errorf("unexpected snapshot: %+v", info)
+	}
+
+	if err := s.Remove(ctx, "container"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(ctx, "base"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebuildMetadataInUse(t *testing.T) {
+	ctx := context.Background()
+	s, volumes := newTestSnapshotter(t, &Config{})
+
+	config := *s.config
+	if err := rebuildMetadata(ctx, &config, volumes); !errdefs.IsFailedPrecondition(err) {
+		t.Fatalf("want failed precondition error, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(config.RootPath, "metadata.db")); err != nil {
+		t.Errorf("want metadata store kept in place, got %v", err)
+	}
+}
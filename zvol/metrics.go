@@ -0,0 +1,175 @@
+package zvol
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "zvol_snapshotter"
+
+// durationBuckets range from a millisecond for metadata lookups to about a
+// minute for creating a file system on a big volume.
+var durationBuckets = prometheus.ExponentialBuckets(0.001, 4, 9)
+
+// collectTimeout bounds collecting the snapshot and dataset metrics, so a
+// hanging pool doesn't hang the scrape.
+var collectTimeout = 5 * time.Second
+
+var (
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of snapshotter operations.",
+		Buckets:   durationBuckets,
+	}, []string{"dataset", "operation"})
+
+	operationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_errors_total",
+		Help:      "Number of failed snapshotter operations.",
+	}, []string{"dataset", "operation"})
+
+	zfsDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "zfs",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of ZFS operations.",
+		Buckets:   durationBuckets,
+	}, []string{"backend", "operation"})
+
+	mkfsDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mkfs_duration_seconds",
+		Help:      "Duration of creating file systems on volumes.",
+		Buckets:   durationBuckets,
+	}, []string{"fs_type"})
+
+	warmPoolHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "warm_pool",
+		Name:      "hits_total",
+		Help:      "Number of snapshots created from a formatted volume of the warm pool.",
+	}, []string{"dataset"})
+
+	warmPoolMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "warm_pool",
+		Name:      "misses_total",
+		Help:      "Number of snapshots that could use the warm pool but found it empty.",
+	}, []string{"dataset"})
+
+	warmPoolVolumes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "warm_pool",
+		Name:      "volumes",
+		Help:      "Number of formatted volumes ready in the warm pool.",
+	}, []string{"dataset"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		operationDuration,
+		operationErrors,
+		zfsDuration,
+		mkfsDuration,
+		warmPoolHits,
+		warmPoolMisses,
+		warmPoolVolumes,
+	)
+}
+
+// snapshotterCollector collects the number of snapshots and the space used by
+// the dataset of a snapshotter when metrics are scraped. The dataset is a
+// constant label of the descriptors, so the collectors of snapshotters served
+// by the same process can be registered side by side.
+type snapshotterCollector struct {
+	s *snapshotter
+
+	snapshotsDesc        *prometheus.Desc
+	datasetUsedDesc      *prometheus.Desc
+	datasetAvailableDesc *prometheus.Desc
+}
+
+func newSnapshotterCollector(s *snapshotter) *snapshotterCollector {
+	labels := prometheus.Labels{"dataset": s.dataset.Name}
+	return &snapshotterCollector{
+		s: s,
+		snapshotsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "snapshots"),
+			"Number of snapshots by kind.",
+			[]string{"kind"}, labels,
+		),
+		datasetUsedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "dataset", "used_bytes"),
+			"Space used by the dataset of the snapshotter and its descendants.",
+			nil, labels,
+		),
+		datasetAvailableDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "dataset", "available_bytes"),
+			"Space available to the dataset of the snapshotter.",
+			nil, labels,
+		),
+	}
+}
+
+func (c *snapshotterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.snapshotsDesc
+	ch <- c.datasetUsedDesc
+	ch <- c.datasetAvailableDesc
+}
+
+func (c *snapshotterCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+	name := c.s.dataset.Name
+
+	// Neither the metadata store nor the zfs command honour ctx, they are
+	// read in the background and skipped when they take too long.
+	counts, err := c.s.calls.do(ctx, "count snapshots", func(ctx context.Context) (any, error) {
+		counts := map[snapshots.Kind]int{
+			snapshots.KindActive:    0,
+			snapshots.KindView:      0,
+			snapshots.KindCommitted: 0,
+		}
+		err := c.s.store.WithTransaction(ctx, false, func(ctx context.Context) error {
+			return storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+				counts[info.Kind]++
+				return nil
+			})
+		})
+		return counts, err
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to count snapshots")
+	} else {
+		for kind, n := range counts.(map[snapshots.Kind]int) {
+			ch <- prometheus.MustNewConstMetric(c.snapshotsDesc, prometheus.GaugeValue, float64(n), kind.String())
+		}
+	}
+
+	d, err := c.s.getDataset(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to get dataset %s", name)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.datasetUsedDesc, prometheus.GaugeValue, float64(d.Used))
+	ch <- prometheus.MustNewConstMetric(c.datasetAvailableDesc, prometheus.GaugeValue, float64(d.Avail))
+}
+
+// getDataset gets the dataset of the snapshotter, giving up when ctx is done.
+// The zfs command hangs while the pool is suspended, so it runs in the
+// background and a command still hanging is not started again.
+func (s *snapshotter) getDataset(ctx context.Context) (*dataset, error) {
+	d, err := s.calls.do(ctx, "get dataset", func(ctx context.Context) (any, error) {
+		return s.volumes.Get(ctx, s.dataset.Name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.(*dataset), nil
+}
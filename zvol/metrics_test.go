@@ -0,0 +1,202 @@
+package zvol
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/errdefs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestSnapshotterMetrics(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		RootPath:   t.TempDir(),
+		Dataset:    testDataset,
+		VolumeSize: "1GiB",
+	}
+
+	volumes := newFakeVolumeManager(t, "tank", testDataset)
+	volumes.datasets[testDataset].Used = 1024
+	volumes.datasets[testDataset].Avail = 4096
+
+	zfsDuration.Reset()
+	mkfsDuration.Reset()
+
+	s, err := newSnapshotter(ctx, config, &instrumentedVolumeManager{volumeManager: volumes, backend: backendCLI})
+	if err != nil {
+		t.Fatal(err)
+	}
+	is, err := newInstrumentedSnapshotter(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := false
+	t.Cleanup(func() {
+		if !closed {
+			is.Close()
+		}
+	})
+
+	if _, err := is.Prepare(ctx, "active", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := is.Prepare(ctx, "base-active", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := is.Commit(ctx, "base", "base-active"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := is.View(ctx, "view", "base"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("operation errors", func(t *testing.T) {
+		errs := testutil.ToFloat64(operationErrors.WithLabelValues(testDataset, "remove"))
+		if err := is.Remove(ctx, "missing"); !errors.Is(err, errdefs.ErrNotFound) {
+			t.Fatalf("want not found error, got %v", err)
+		}
+		if got := testutil.ToFloat64(operationErrors.WithLabelValues(testDataset, "remove")) - errs; got != 1 {
+			t.Errorf("want 1 remove error, got %v", got)
+		}
+	})
+
+	t.Run("snapshots", func(t *testing.T) {
+		want := `
+# HELP zvol_snapshotter_dataset_available_bytes Space available to the dataset of the snapshotter.
+# TYPE zvol_snapshotter_dataset_available_bytes gauge
+zvol_snapshotter_dataset_available_bytes{dataset="tank/containerd"} 4096
+# HELP zvol_snapshotter_dataset_used_bytes Space used by the dataset of the snapshotter and its descendants.
+# TYPE zvol_snapshotter_dataset_used_bytes gauge
+zvol_snapshotter_dataset_used_bytes{dataset="tank/containerd"} 1024
+# HELP zvol_snapshotter_snapshots Number of snapshots by kind.
+# TYPE zvol_snapshotter_snapshots gauge
+zvol_snapshotter_snapshots{dataset="tank/containerd",kind="Active"} 1
+zvol_snapshotter_snapshots{dataset="tank/containerd",kind="Committed"} 1
+zvol_snapshotter_snapshots{dataset="tank/containerd",kind="View"} 1
+`
+		if err := testutil.CollectAndCompare(is.collector, strings.NewReader(want)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("hanging pool", func(t *testing.T) {
+		timeout := collectTimeout
+		collectTimeout = 10 * time.Millisecond
+		defer func() { collectTimeout = timeout }()
+
+		release := make(chan struct{})
+		var gets atomic.Int32
+		volumes.getDataset = func(name string) error {
+			gets.Add(1)
+			<-release
+			return nil
+		}
+		defer func() {
+			close(release)
+			volumes.getDataset = nil
+		}()
+
+		// The scrape doesn't wait for the hanging zfs command, and later
+		// scrapes don't start another one.
+		for range 2 {
+			if n := testutil.CollectAndCount(is.collector, "zvol_snapshotter_dataset_used_bytes"); n != 0 {
+				t.Errorf("want no dataset metrics, got %d", n)
+			}
+		}
+		if n := testutil.CollectAndCount(is.collector, "zvol_snapshotter_snapshots"); n != 3 {
+			t.Errorf("want 3 snapshot metrics, got %d", n)
+		}
+		if n := gets.Load(); n != 1 {
+			t.Errorf("want 1 zfs command, got %d", n)
+		}
+	})
+
+	t.Run("zfs operations", func(t *testing.T) {
+		for _, op := range []string{"create_volume", "clone", "commit"} {
+			h, err := zfsDuration.GetMetricWithLabelValues(string(backendCLI), op)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := histogramCount(t, h); n == 0 {
+				t.Errorf("want %s durations, got none", op)
+			}
+		}
+
+		h, err := mkfsDuration.GetMetricWithLabelValues(string(fsTypeExt4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := histogramCount(t, h); n != 2 {
+			t.Errorf("want 2 mkfs durations, got %d", n)
+		}
+	})
+
+	t.Run("multiple datasets", func(t *testing.T) {
+		other := testDataset + "-hdd"
+		volumes := newFakeVolumeManager(t, "tank", other)
+		config := &Config{
+			RootPath:   t.TempDir(),
+			Dataset:    other,
+			VolumeSize: "1GiB",
+		}
+
+		s, err := newSnapshotter(ctx, config, volumes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ois, err := newInstrumentedSnapshotter(s)
+		if err != nil {
+			t.Fatalf("want collector of a second dataset to be registered, got %v", err)
+		}
+		defer ois.Close()
+	})
+
+	t.Run("same dataset", func(t *testing.T) {
+		config := &Config{
+			RootPath:   t.TempDir(),
+			Dataset:    testDataset,
+			VolumeSize: "1GiB",
+		}
+
+		s, err := newSnapshotter(ctx, config, newFakeVolumeManager(t, "tank", testDataset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if _, err := newInstrumentedSnapshotter(s); err == nil {
+			t.Error("want error registering a second collector of the same dataset, got nil")
+		}
+	})
+
+	t.Run("unregister", func(t *testing.T) {
+		closed = true
+		if err := is.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if prometheus.Unregister(is.collector) {
+			t.Error("want collector to be unregistered on close")
+		}
+	})
+}
+
+func histogramCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+
+	m, ok := o.(prometheus.Metric)
+	if !ok {
+		t.Fatalf("want histogram metric, got %T", o)
+	}
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	return pb.GetHistogram().GetSampleCount()
+}
@@ -0,0 +1,118 @@
+package zvol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// nvlist is a list of name-value pairs as used by the zfs ioctl interface.
+// Values can be nil for a boolean flag, int32, uint64, string or a nested
+// nvlist.
+type nvlist []nvpair
+
+type nvpair struct {
+	name  string
+	value any
+}
+
+// Data types, flags and sizes of the native nvlist encoding, see
+// include/sys/nvpair.h in OpenZFS.
+const (
+	nvEncodeNative = 0
+	nvBigEndian    = 0
+	nvLittleEndian = 1
+	nvVersion      = 0
+	nvUniqueName   = 1
+
+	nvDataTypeBoolean = 1
+	nvDataTypeInt32   = 5
+	nvDataTypeUint64  = 8
+	nvDataTypeString  = 9
+	nvDataTypeNvlist  = 19
+
+	// nvPairHeaderSize is the size of nvpair_t without name and value.
+	nvPairHeaderSize = 16
+	// nvlistSize is the size of nvlist_t, the value of nested nvlist pairs.
+	nvlistSize = 24
+)
+
+// nvHostEndian is the endianness of the nvlist header for the byte order of
+// the host, in which the native encoding is written.
+var nvHostEndian = func() byte {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) == 1 {
+		return nvLittleEndian
+	}
+	return nvBigEndian
+}()
+
+func nvAlign(n int) int {
+	return (n + 7) &^ 7
+}
+
+// pack encodes the nvlist in the native encoding in the byte order of the
+// host, the same as nvlist_pack with NV_ENCODE_NATIVE.
+func (l nvlist) pack() ([]byte, error) {
+	b := []byte{nvEncodeNative, nvHostEndian, 0, 0}
+	return l.encode(b)
+}
+
+func (l nvlist) encode(b []byte) ([]byte, error) {
+	b = binary.NativeEndian.AppendUint32(b, nvVersion)
+	b = binary.NativeEndian.AppendUint32(b, nvUniqueName)
+
+	for _, p := range l {
+		var (
+			dataType int32
+			elements int32 = 1
+			value    []byte
+		)
+
+		switch v := p.value.(type) {
+		case nil:
+			dataType = nvDataTypeBoolean
+			elements = 0
+		case int32:
+			dataType = nvDataTypeInt32
+			value = binary.NativeEndian.AppendUint32(nil, uint32(v))
+		case uint64:
+			dataType = nvDataTypeUint64
+			value = binary.NativeEndian.AppendUint64(nil, v)
+		case string:
+			dataType = nvDataTypeString
+			value = append([]byte(v), 0)
+		case nvlist:
+			dataType = nvDataTypeNvlist
+			// The nvlist_t of a nested nvlist, only the version and flags
+			// are used by the decoder.
+			value = make([]byte, nvlistSize)
+			binary.NativeEndian.PutUint32(value[0:], nvVersion)
+			binary.NativeEndian.PutUint32(value[4:], nvUniqueName)
+		default:
+			return nil, fmt.Errorf("unsupported nvlist value type %T for %q", p.value, p.name)
+		}
+
+		nameSize := len(p.name) + 1
+		valueOffset := nvAlign(nvPairHeaderSize + nameSize)
+		size := valueOffset + nvAlign(len(value))
+
+		pair := make([]byte, size)
+		binary.NativeEndian.PutUint32(pair[0:], uint32(size))
+		binary.NativeEndian.PutUint16(pair[4:], uint16(nameSize))
+		binary.NativeEndian.PutUint32(pair[8:], uint32(elements))
+		binary.NativeEndian.PutUint32(pair[12:], uint32(dataType))
+		copy(pair[nvPairHeaderSize:], p.name)
+		copy(pair[valueOffset:], value)
+		b = append(b, pair...)
+
+		// Nested nvlists follow their pair.
+		if nested, ok := p.value.(nvlist); ok {
+			var err error
+			if b, err = nested.encode(b); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Four zero bytes mark the end of the nvlist.
+	return append(b, 0, 0, 0, 0), nil
+}
@@ -0,0 +1,125 @@
+package zvol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestNvlistPack(t *testing.T) {
+	t.Run("scalars", func(t *testing.T) {
+		if nvHostEndian != nvLittleEndian {
+			t.Skip("the expected encoding is little-endian")
+		}
+
+		got, err := nvlist{
+			{"a", uint64(1)},
+			{"type", int32(3)},
+			{"s", "lz4"},
+		}.pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []byte{
+			// header: native encoding, little-endian
+			0, 1, 0, 0,
+			// nvlist version and flags
+			0, 0, 0, 0, 1, 0, 0, 0,
+			// "a": size 32, name size 2, 1 element of type uint64
+			32, 0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 8, 0, 0, 0,
+			'a', 0, 0, 0, 0, 0, 0, 0,
+			1, 0, 0, 0, 0, 0, 0, 0,
+			// "type": size 32, name size 5, 1 element of type int32
+			32, 0, 0, 0, 5, 0, 0, 0, 1, 0, 0, 0, 5, 0, 0, 0,
+			't', 'y', 'p', 'e', 0, 0, 0, 0,
+			3, 0, 0, 0, 0, 0, 0, 0,
+			// "s": size 32, name size 2, 1 element of type string
+			32, 0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 9, 0, 0, 0,
+			's', 0, 0, 0, 0, 0, 0, 0,
+			'l', 'z', '4', 0, 0, 0, 0, 0,
+			// end
+			0, 0, 0, 0,
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		if nvHostEndian != nvLittleEndian {
+			t.Skip("the expected encoding is little-endian")
+		}
+
+		got, err := nvlist{
+			{"snaps", nvlist{{"p@s", nil}}},
+		}.pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []byte{
+			0, 1, 0, 0,
+			0, 0, 0, 0, 1, 0, 0, 0,
+			// "snaps": size 48, name size 6, 1 element of type nvlist
+			48, 0, 0, 0, 6, 0, 0, 0, 1, 0, 0, 0, 19, 0, 0, 0,
+			's', 'n', 'a', 'p', 's', 0, 0, 0,
+			0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			// nested nvlist version and flags
+			0, 0, 0, 0, 1, 0, 0, 0,
+			// "p@s": size 24, name size 4, boolean without elements
+			24, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0,
+			'p', '@', 's', 0, 0, 0, 0, 0,
+			// end of nested nvlist
+			0, 0, 0, 0,
+			// end
+			0, 0, 0, 0,
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	})
+
+	t.Run("unsupported type", func(t *testing.T) {
+		if _, err := (nvlist{{"a", 1.5}}).pack(); err == nil {
+			t.Errorf("want error, got nil")
+		}
+	})
+
+	t.Run("host byte order", func(t *testing.T) {
+		got, err := nvlist{{"a", uint64(1)}}.pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []byte{
+			// header: native encoding, little-endian
+			0, 1, 0, 0,
+			// nvlist version and flags
+			0, 0, 0, 0, 1, 0, 0, 0,
+			// "a": size 32, name size 2, 1 element of type uint64
+			32, 0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 8, 0, 0, 0,
+			'a', 0, 0, 0, 0, 0, 0, 0,
+			1, 0, 0, 0, 0, 0, 0, 0,
+			// end
+			0, 0, 0, 0,
+		}
+		if binary.NativeEndian.Uint16([]byte{0, 1}) == 1 {
+			want = []byte{
+				// header: native encoding, big-endian
+				0, 0, 0, 0,
+				// nvlist version and flags
+				0, 0, 0, 0, 0, 0, 0, 1,
+				// "a": size 32, name size 2, 1 element of type uint64
+				0, 0, 0, 32, 0, 2, 0, 0, 0, 0, 0, 1, 0, 0, 0, 8,
+				'a', 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 1,
+				// end
+				0, 0, 0, 0,
+			}
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package zvol
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/containerd/errdefs"
+)
+
+// zfsVolumeProperties lists the native ZFS properties that can be set on
+// volumes. The value reports whether the property can only be set when the
+// volume is created. Clones inherit those properties from their origin.
+//
+// See https://openzfs.github.io/openzfs-docs/man/7/zfsprops.7.html.
+var zfsVolumeProperties = map[string]bool{
+	"checksum":           false,
+	"compression":        false,
+	"copies":             false,
+	"dedup":              false,
+	"encryption":         true,
+	"keyformat":          true,
+	"keylocation":        false,
+	"logbias":            false,
+	"pbkdf2iters":        true,
+	"primarycache":       false,
+	"readonly":           false,
+	"redundant_metadata": false,
+	"refreservation":     false,
+	"reservation":        false,
+	"secondarycache":     false,
+	"snapdev":            false,
+	"snapshot_limit":     false,
+	"sync":               false,
+	"volblocksize":       true,
+}
+
+// zfsManagedProperties lists properties the snapshotter manages itself.
+var zfsManagedProperties = []string{
+	"volmode",
+	"volsize",
+}
+
+// zfsUserPropertyPrefix is the namespace of user properties owned by the
+// snapshotter.
+const zfsUserPropertyPrefix = "containerd:"
+
+func isZfsUserProperty(name string) bool {
+	return strings.Contains(name, ":")
+}
+
+// isCreateOnlyProperty reports whether a property can only be set when a
+// volume is created.
+func isCreateOnlyProperty(name string) bool {
+	return zfsVolumeProperties[name]
+}
+
+// validateVolumeProperty checks a property name can be configured for volumes.
+func validateVolumeProperty(name string) error {
+	switch {
+	case isZfsUserProperty(name):
+		if strings.HasPrefix(name, zfsUserPropertyPrefix) {
+			return fmt.Errorf("zfs user property %q is reserved", name)
+		}
+	case slices.Contains(zfsManagedProperties, name):
+		return fmt.Errorf("zfs property %q is managed by the snapshotter", name)
+	default:
+		if _, ok := zfsVolumeProperties[name]; !ok {
+			return fmt.Errorf("unsupported zfs volume property: %q", name)
+		}
+	}
+
+	return nil
+}
+
+// createVolumeProperties returns the properties for newly created volumes.
+// Later property maps take precedence over earlier ones.
+func createVolumeProperties(properties ...map[string]string) map[string]string {
+	props := maps.Clone(zfsCreateVolumeProperties)
+	for _, p := range properties {
+		maps.Copy(props, p)
+	}
+	return props
+}
+
+// cloneVolumeProperties returns the properties for clones, leaving out
+// properties that can only be set when a volume is created.
+func cloneVolumeProperties(properties ...map[string]string) map[string]string {
+	props := createVolumeProperties(properties...)
+	maps.DeleteFunc(props, func(name, _ string) bool {
+		return isCreateOnlyProperty(name)
+	})
+	return props
+}
+
+// getLabelProperties returns the ZFS properties requested through snapshot
+// labels. Only properties in the allowed list can be set. Properties that can
+// only be set when a volume is created are rejected for clones.
+func getLabelProperties(labels map[string]string, allowed []string, clone bool) (map[string]string, error) {
+	props := make(map[string]string)
+	for key, value := range labels {
+		name, ok := strings.CutPrefix(key, LabelPropertyPrefix)
+		if !ok {
+			continue
+		}
+
+		if !slices.Contains(allowed, name) {
+			return nil, fmt.Errorf("zfs property %q is not allowed: %w", name, errdefs.ErrInvalidArgument)
+		}
+
+		if clone && isCreateOnlyProperty(name) {
+			return nil, fmt.Errorf("zfs property %q can only be set on snapshots without a parent: %w", name, errdefs.ErrInvalidArgument)
+		}
+
+		props[name] = value
+	}
+
+	return props, nil
+}
@@ -0,0 +1,96 @@
+package zvol
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/containerd/errdefs"
+)
+
+func TestVolumeProperties(t *testing.T) {
+	properties := map[string]string{
+		"compression":    "zstd",
+		"volblocksize":   "16K",
+		"refreservation": "auto",
+	}
+
+	t.Run("create", func(t *testing.T) {
+		want := map[string]string{
+			"compression":    "zstd",
+			"volblocksize":   "16K",
+			"refreservation": "auto",
+			"volmode":        "full",
+		}
+
+		got := createVolumeProperties(properties)
+		if !maps.Equal(got, want) {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	})
+
+	t.Run("clone", func(t *testing.T) {
+		want := map[string]string{
+			"compression":    "zstd",
+			"refreservation": "auto",
+			"volmode":        "full",
+		}
+
+		got := cloneVolumeProperties(properties)
+		if !maps.Equal(got, want) {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		got := createVolumeProperties(nil)
+		if !maps.Equal(got, zfsCreateVolumeProperties) {
+			t.Errorf("want %v, got %v", zfsCreateVolumeProperties, got)
+		}
+	})
+}
+
+func TestGetLabelProperties(t *testing.T) {
+	allowed := []string{"compression", "volblocksize"}
+
+	t.Run("allowed properties", func(t *testing.T) {
+		labels := map[string]string{
+			LabelPropertyPrefix + "compression":  "zstd",
+			LabelPropertyPrefix + "volblocksize": "16K",
+			LabelVolumeSize:                      "1073741824",
+		}
+		want := map[string]string{
+			"compression":  "zstd",
+			"volblocksize": "16K",
+		}
+
+		got, err := getLabelProperties(labels, allowed, false)
+		if err != nil {
+			t.Errorf("want nil, got error: %s", err)
+		}
+		if !maps.Equal(got, want) {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	})
+
+	t.Run("property not allowed", func(t *testing.T) {
+		labels := map[string]string{
+			LabelPropertyPrefix + "sync": "disabled",
+		}
+
+		_, err := getLabelProperties(labels, allowed, false)
+		if !errdefs.IsInvalidArgument(err) {
+			t.Errorf("want invalid argument error, got: %v", err)
+		}
+	})
+
+	t.Run("create only property on clone", func(t *testing.T) {
+		labels := map[string]string{
+			LabelPropertyPrefix + "volblocksize": "16K",
+		}
+
+		_, err := getLabelProperties(labels, allowed, true)
+		if !errdefs.IsInvalidArgument(err) {
+			t.Errorf("want invalid argument error, got: %v", err)
+		}
+	})
+}
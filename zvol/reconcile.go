@@ -0,0 +1,389 @@
+package zvol
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+type reconcilePolicy string
+
+const (
+	// reconcilePolicyNone skips reconciliation at startup.
+	reconcilePolicyNone reconcilePolicy = "none"
+	// reconcilePolicyReport logs differences between the metadata store and
+	// the zfs datasets.
+	reconcilePolicyReport reconcilePolicy = "report"
+	// reconcilePolicyRepair logs and repairs differences between the metadata
+	// store and the zfs datasets.
+	reconcilePolicyRepair reconcilePolicy = "repair"
+)
+
+// zvolState holds the zfs datasets of a snapshot.
+type zvolState struct {
+	// volume is the zfs volume of the snapshot.
+	volume *dataset
+	// snapshot is the zfs snapshot of the volume, only present for committed
+	// snapshots.
+	snapshot *dataset
+}
+
+// metadataSnapshot is a snapshot recorded in the metadata store.
+type metadataSnapshot struct {
+	id   string
+	key  string
+	kind snapshots.Kind
+	// reserved is set when the volume of the snapshot was still being
+	// created, see createSnapshot.
+	reserved bool
+}
+
+// reconcileReport lists the differences between the metadata store and the
+// zfs datasets.
+type reconcileReport struct {
+	// zvols are the zfs datasets the report is based on by snapshot ID.
+	zvols map[string]*zvolState
+	// orphans are snapshot IDs with zfs datasets but without metadata.
+	orphans []string
+	// dangling are snapshots with metadata but missing zfs datasets.
+	dangling []metadataSnapshot
+	// uncommitted are active snapshots with a leftover zfs snapshot from an
+	// interrupted commit.
+	uncommitted []metadataSnapshot
+	// unfinished are reserved snapshots without any zfs datasets, left by a
+	// crash between reserving the metadata of a snapshot and creating its
+	// volume.
+	unfinished []metadataSnapshot
+}
+
+func (r *reconcileReport) empty() bool {
+	return len(r.orphans) == 0 && len(r.dangling) == 0 && len(r.uncommitted) == 0 && len(r.unfinished) == 0
+}
+
+// listZvols returns the zfs datasets managed by the snapshotter by snapshot ID.
+// Only children of the snapshotter dataset named after a snapshot ID are
+// considered managed by the snapshotter.
+func (s *snapshotter) listZvols(ctx context.Context) (map[string]*zvolState, error) {
+	children, err := s.volumes.Children(ctx, s.dataset.Name, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	zvols := make(map[string]*zvolState)
+	for _, child := range children {
+		name, ok := strings.CutPrefix(child.Name, s.dataset.Name+"/")
+		if !ok {
+			continue
+		}
+
+		id, snapshot, _ := strings.Cut(name, "@")
+		if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+			continue
+		}
+
+		state, ok := zvols[id]
+		if !ok {
+			state = &zvolState{}
+			zvols[id] = state
+		}
+
+		switch snapshot {
+		case "":
+			state.volume = child
+		case snapshotSuffix:
+			state.snapshot = child
+		}
+	}
+
+	return zvols, nil
+}
+
+// listMetadataSnapshots returns all snapshots in the metadata store. Requires
+// a context with a storage transaction.
+func listMetadataSnapshots(ctx context.Context) ([]metadataSnapshot, error) {
+	ids, err := storage.IDMap(ctx)
+	if err != nil {
+		// The buckets are created with the first snapshot.
+		if errdefs.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	kinds := make(map[string]snapshots.Kind, len(ids))
+	if err := storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+		kinds[info.Name] = info.Kind
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	snaps := make([]metadataSnapshot, 0, len(ids))
+	for id, key := range ids {
+		snaps = append(snaps, metadataSnapshot{
+			id:   id,
+			key:  key,
+			kind: kinds[key],
+		})
+	}
+
+	return snaps, nil
+}
+
+// compareIDs orders snapshot IDs from newest to oldest. Children are always
+// created after their parent so this order allows removing children first.
+func compareIDs(a, b string) int {
+	x, _ := strconv.ParseUint(a, 10, 64)
+	y, _ := strconv.ParseUint(b, 10, 64)
+	return cmp.Compare(y, x)
+}
+
+func newReconcileReport(zvols map[string]*zvolState, snaps []metadataSnapshot) *reconcileReport {
+	report := &reconcileReport{zvols: zvols}
+
+	known := make(map[string]bool, len(snaps))
+	for _, snap := range snaps {
+		known[snap.id] = true
+
+		state := zvols[snap.id]
+		switch {
+		case state == nil && snap.reserved:
+			report.unfinished = append(report.unfinished, snap)
+		case state == nil || state.volume == nil:
+			report.dangling = append(report.dangling, snap)
+		case snap.kind == snapshots.KindCommitted && state.snapshot == nil:
+			report.dangling = append(report.dangling, snap)
+		case snap.kind != snapshots.KindCommitted && state.snapshot != nil:
+			report.uncommitted = append(report.uncommitted, snap)
+		}
+	}
+
+	for id := range zvols {
+		if !known[id] {
+			report.orphans = append(report.orphans, id)
+		}
+	}
+
+	slices.SortFunc(report.orphans, compareIDs)
+	slices.SortFunc(report.dangling, func(a, b metadataSnapshot) int {
+		return compareIDs(a.id, b.id)
+	})
+	slices.SortFunc(report.uncommitted, func(a, b metadataSnapshot) int {
+		return compareIDs(a.id, b.id)
+	})
+	slices.SortFunc(report.unfinished, func(a, b metadataSnapshot) int {
+		return compareIDs(a.id, b.id)
+	})
+
+	return report
+}
+
+// reconcile compares the metadata store with the zfs datasets of the
+// snapshotter. Datasets without metadata can be left behind when the daemon
+// crashes while creating a snapshot, metadata without datasets when datasets
+// are destroyed outside of the snapshotter. Depending on the reconcile policy
+// differences are only reported or also repaired.
+func (s *snapshotter) reconcile(ctx context.Context) error {
+	policy := s.config.ReconcilePolicy
+	if policy == reconcilePolicyNone {
+		return nil
+	}
+
+	var report *reconcileReport
+	err := withBoltTransaction(ctx, s.store, false, func(ctx context.Context, tx *bolt.Tx) error {
+		zvols, err := s.listZvols(ctx)
+		if err != nil {
+			return err
+		}
+
+		snaps, err := listMetadataSnapshots(ctx)
+		if err != nil {
+			return err
+		}
+
+		reserved, err := reservedIDs(tx)
+		if err != nil {
+			return err
+		}
+		for i := range snaps {
+			snaps[i].reserved = reserved[snaps[i].id]
+		}
+
+		report = newReconcileReport(zvols, snaps)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reconcile metadata with zfs datasets: %w", err)
+	}
+
+	for _, id := range report.orphans {
+		log.G(ctx).Warnf("zfs volume %s has no snapshot metadata", path.Join(s.dataset.Name, id))
+	}
+	for _, snap := range report.dangling {
+		log.G(ctx).Warnf("%s snapshot %q is missing zfs datasets for %s", snap.kind, snap.key, path.Join(s.dataset.Name, snap.id))
+	}
+	for _, snap := range report.uncommitted {
+		log.G(ctx).Warnf("%s snapshot %q has a leftover zfs snapshot %s", snap.kind, snap.key, path.Join(s.dataset.Name, snap.id+"@"+snapshotSuffix))
+	}
+
+	// Unfinished snapshots have no data and would block their key forever,
+	// their metadata is removed with any reconcile policy.
+	if err := s.removeUnfinished(ctx, report.unfinished); err != nil {
+		log.G(ctx).WithError(err).Error("failed to remove metadata of unfinished snapshots")
+	}
+
+	if len(report.orphans) == 0 && len(report.dangling) == 0 && len(report.uncommitted) == 0 {
+		log.G(ctx).Debug("metadata is consistent with zfs datasets")
+		return nil
+	}
+
+	if policy != reconcilePolicyRepair {
+		log.G(ctx).Warnf("metadata is inconsistent with zfs datasets: %d orphaned volumes, %d dangling snapshots, %d interrupted commits",
+			len(report.orphans), len(report.dangling), len(report.uncommitted))
+		return nil
+	}
+
+	// Repair failures are logged but don't prevent the snapshotter from starting.
+	if err := s.repair(ctx, report); err != nil {
+		log.G(ctx).WithError(err).Error("failed to repair metadata inconsistencies")
+	}
+
+	return nil
+}
+
+// removeUnfinished removes the metadata of snapshots whose volume was never
+// created, and the reservations left by snapshots that were created. The
+// reservation of a snapshot whose metadata can't be removed is kept.
+func (s *snapshotter) removeUnfinished(ctx context.Context, unfinished []metadataSnapshot) error {
+	var errs []error
+	err := withBoltTransaction(ctx, s.store, true, func(ctx context.Context, tx *bolt.Tx) error {
+		reserved, err := reservedIDs(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, snap := range unfinished {
+			if _, _, err := storage.Remove(ctx, snap.key); err != nil {
+				errs = append(errs, fmt.Errorf("failed to remove metadata of snapshot %q: %w", snap.key, err))
+				delete(reserved, snap.id)
+				continue
+			}
+			log.G(ctx).Infof("removed metadata of unfinished %s snapshot %q", snap.kind, snap.key)
+		}
+
+		for id := range reserved {
+			if err := clearReserved(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// repair resolves the differences in the report by destroying orphaned zfs
+// datasets, removing dangling metadata and rolling back interrupted commits.
+func (s *snapshotter) repair(ctx context.Context, report *reconcileReport) error {
+	var errs []error
+
+	for _, id := range report.orphans {
+		if err := s.destroyOrphan(ctx, report.zvols[id]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, snap := range report.uncommitted {
+		if err := s.rollbackCommit(ctx, snap.id, nil); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.G(ctx).Infof("rolled back interrupted commit of snapshot %q", snap.key)
+	}
+
+	err := s.store.WithTransaction(ctx, true, func(ctx context.Context) error {
+		for _, snap := range report.dangling {
+			// Destroy whatever is left of the zfs datasets first so they
+			// don't become orphans.
+			if err := s.destroyZvol(ctx, snap.id); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			if _, _, err := storage.Remove(ctx, snap.key); err != nil {
+				errs = append(errs, fmt.Errorf("failed to remove metadata of snapshot %q: %w", snap.key, err))
+				continue
+			}
+			log.G(ctx).Infof("removed dangling metadata of snapshot %q", snap.key)
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// destroyOrphan destroys the zfs datasets of a snapshot without metadata. A
+// zfs snapshot that still has clones is marked for deferred destruction, zfs
+// destroys it once the last clone is gone and the volume is destroyed by a
+// later cleanup.
+func (s *snapshotter) destroyOrphan(ctx context.Context, state *zvolState) error {
+	if state.snapshot != nil {
+		clones, err := s.volumes.GetProperty(ctx, state.snapshot.Name, "clones")
+		if err != nil {
+			return err
+		}
+
+		if err := s.volumes.Destroy(ctx, state.snapshot.Name, destroyDeferDeletion); err != nil {
+			return fmt.Errorf("failed to destroy ZFS snapshot %s: %w", state.snapshot.Name, err)
+		}
+
+		if clones != "" {
+			log.G(ctx).Debugf("ZFS snapshot %s has clones, marked for deferred destruction", state.snapshot.Name)
+			return nil
+		}
+		log.G(ctx).Infof("destroyed ZFS snapshot %s", state.snapshot.Name)
+	}
+
+	if state.volume != nil {
+		if err := s.volumes.Destroy(ctx, state.volume.Name, destroyDefault); err != nil {
+			return fmt.Errorf("failed to destroy ZFS dataset %s: %w", state.volume.Name, err)
+		}
+		log.G(ctx).Infof("destroyed ZFS dataset %s", state.volume.Name)
+	}
+
+	return nil
+}
+
+// destroyZvol destroys the zfs volume of a snapshot including its zfs
+// snapshot, if they exist.
+func (s *snapshotter) destroyZvol(ctx context.Context, id string) error {
+	volumeName := path.Join(s.dataset.Name, id)
+	if _, err := s.volumes.Get(ctx, volumeName); err != nil {
+		// Volume might already be destroyed
+		log.G(ctx).WithError(err).Debugf("ZFS dataset %s not found, may already be destroyed", volumeName)
+		return nil
+	}
+
+	if err := s.volumes.Destroy(ctx, volumeName, destroyRecursive); err != nil {
+		return fmt.Errorf("failed to destroy ZFS dataset %s: %w", volumeName, err)
+	}
+
+	log.G(ctx).Infof("destroyed ZFS dataset %s", volumeName)
+	return nil
+}
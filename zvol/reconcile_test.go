@@ -0,0 +1,57 @@
+package zvol
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+)
+
+func TestNewReconcileReport(t *testing.T) {
+	volume := &dataset{}
+	snapshot := &dataset{}
+
+	zvols := map[string]*zvolState{
+		"1":  {volume: volume, snapshot: snapshot},
+		"2":  {volume: volume},
+		"3":  {volume: volume, snapshot: snapshot},
+		"5":  {volume: volume},
+		"10": {volume: volume, snapshot: snapshot},
+		"11": {volume: volume},
+	}
+
+	snaps := []metadataSnapshot{
+		{id: "1", key: "committed", kind: snapshots.KindCommitted},
+		{id: "2", key: "active", kind: snapshots.KindActive},
+		{id: "3", key: "uncommitted", kind: snapshots.KindActive},
+		{id: "4", key: "missing", kind: snapshots.KindView},
+		{id: "5", key: "missing-snapshot", kind: snapshots.KindCommitted},
+		{id: "6", key: "unfinished", kind: snapshots.KindActive, reserved: true},
+	}
+
+	report := newReconcileReport(zvols, snaps)
+
+	if want := []string{"11", "10"}; !slices.Equal(report.orphans, want) {
+		t.Errorf("want orphans %v, got %v", want, report.orphans)
+	}
+
+	var dangling []string
+	for _, snap := range report.dangling {
+		dangling = append(dangling, snap.key)
+	}
+	if want := []string{"missing-snapshot", "missing"}; !slices.Equal(dangling, want) {
+		t.Errorf("want dangling %v, got %v", want, dangling)
+	}
+
+	if len(report.uncommitted) != 1 || report.uncommitted[0].key != "uncommitted" {
+		t.Errorf("want uncommitted [uncommitted], got %v", report.uncommitted)
+	}
+
+	if len(report.unfinished) != 1 || report.unfinished[0].key != "unfinished" {
+		t.Errorf("want unfinished [unfinished], got %v", report.unfinished)
+	}
+
+	if report := newReconcileReport(nil, nil); !report.empty() {
+		t.Errorf("want empty report, got %v", report)
+	}
+}
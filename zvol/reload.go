@@ -0,0 +1,162 @@
+package zvol
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+	"sync"
+
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+)
+
+// immutableConfigChanges returns the settings that differ between two configs
+// but can only be changed by restarting the snapshotter.
+func immutableConfigChanges(old, config *Config) []string {
+	var changed []string
+	if config.RootPath != old.RootPath {
+		changed = append(changed, "root_path")
+	}
+	if config.Dataset != old.Dataset {
+		changed = append(changed, "dataset")
+	}
+	if config.Backend != old.Backend {
+		changed = append(changed, "backend")
+	}
+	return changed
+}
+
+// emptyVolumesChanged reports whether the base templates and the warm pool
+// must be set up again for a new config.
+func emptyVolumesChanged(old, config *Config) bool {
+	return config.volumeSizeBytes != old.volumeSizeBytes ||
+		config.FileSystemType != old.FileSystemType ||
+		!maps.Equal(config.VolumeProperties, old.VolumeProperties) ||
+		config.BaseTemplate != old.BaseTemplate ||
+		config.WarmPoolSize != old.WarmPoolSize ||
+		config.WarmPoolConcurrency != old.WarmPoolConcurrency
+}
+
+// CheckConfig reports whether Reload would accept a config, without applying
+// it. Callers reloading several snapshotters together check the config of
+// each of them first.
+func (s *snapshotter) CheckConfig(ctx context.Context, config *Config) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.ops.Done()
+
+	s.configMu.RLock()
+	old := s.config
+	s.configMu.RUnlock()
+
+	return s.checkConfig(ctx, old, config)
+}
+
+// checkConfig checks that a config is valid and only changes the settings of
+// the running config old that can be reloaded.
+func (s *snapshotter) checkConfig(ctx context.Context, old, config *Config) error {
+	if err := config.Parse(); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %w: %w", err, errdefs.ErrInvalidArgument)
+	}
+
+	if changed := immutableConfigChanges(old, config); len(changed) > 0 {
+		return fmt.Errorf("changing %s requires a restart: %w", strings.Join(changed, ", "), errdefs.ErrInvalidArgument)
+	}
+
+	return s.volumes.CheckVolumeProperties(ctx, s.dataset.Name, config.volumeSizeBytes, createVolumeProperties(config.VolumeProperties))
+}
+
+// Reload applies a new config to the running snapshotter. The quota of the
+// dataset is set right away. The volume size, file system type, volume
+// properties, allowed label properties, block device mode, base templates and
+// warm pool settings take effect for snapshots created afterwards. The config
+// is rejected as a whole when it is invalid or changes settings that require
+// a restart, like the dataset or root path.
+//
+// The templates of the new config are created before it is applied, so
+// snapshots are not blocked while they are formatted. Snapshots being created
+// when the config is applied are finished with the previous config, Reload
+// waits for them before the previous warm pool is stopped and the previous
+// templates are cleaned up, without blocking new snapshots. The warm pool is
+// started again for the new config once the previous one is stopped,
+// snapshots created in between don't use it.
+func (s *snapshotter) Reload(ctx context.Context, config *Config) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.ops.Done()
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.configMu.RLock()
+	old := s.config
+	s.configMu.RUnlock()
+
+	if err := s.checkConfig(ctx, old, config); err != nil {
+		return err
+	}
+
+	if config.quotaProperty != old.quotaProperty {
+		if err := s.setQuota(ctx, config); err != nil {
+			return err
+		}
+	}
+
+	if !emptyVolumesChanged(old, config) {
+		s.configMu.Lock()
+		s.config = config
+		s.configMu.Unlock()
+
+		log.G(ctx).Info("reloaded config")
+		return nil
+	}
+
+	// The new config is applied even when the templates or the warm pool
+	// could not be set up, snapshots are then created with mkfs.
+	t, err := s.setupTemplates(ctx, config)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to set up base templates for reloaded config")
+	}
+
+	s.configMu.Lock()
+	pool := s.warmPool
+	creating := s.creating
+	s.config = config
+	s.templates = t
+	s.warmPool = nil
+	s.creating = &sync.WaitGroup{}
+	s.configMu.Unlock()
+
+	creating.Wait()
+
+	if pool != nil {
+		pool.close()
+	}
+
+	// The templates of the previous config are only destroyed once the
+	// previous warm pool and the snapshots being created no longer clone
+	// them.
+	if t != nil {
+		if err := t.cleanup(ctx); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to clean up outdated templates")
+		}
+	}
+
+	pool, err = s.startWarmPool(ctx, config, t)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to start warm pool for reloaded config")
+	}
+
+	s.configMu.Lock()
+	s.warmPool = pool
+	s.configMu.Unlock()
+
+	log.G(ctx).Info("reloaded config")
+	return nil
+}
@@ -0,0 +1,303 @@
+package zvol
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/errdefs"
+)
+
+func TestSnapshotterReload(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("volume size", func(t *testing.T) {
+		s, volumes := newTestSnapshotter(t, &Config{})
+
+		config := *s.config
+		config.VolumeSize = "2GiB"
+		config.VolumeProperties = map[string]string{"compression": "zstd"}
+		if err := s.Reload(ctx, &config); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.Prepare(ctx, "active", ""); err != nil {
+			t.Fatal(err)
+		}
+		d, err := volumes.Get(ctx, testDataset+"/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Volsize != 2<<30 {
+			t.Errorf("want volume size %d, got %d", 2<<30, d.Volsize)
+		}
+		if v, _ := volumes.GetProperty(ctx, d.Name, "compression"); v != "zstd" {
+			t.Errorf("want compression %q, got %q", "zstd", v)
+		}
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		s, volumes := newTestSnapshotter(t, &Config{})
+
+		config := *s.config
+		config.Quota = "10GiB"
+		if err := s.Reload(ctx, &config); err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := volumes.GetProperty(ctx, testDataset, "quota"); v != "10737418240" {
+			t.Errorf("want quota %q, got %q", "10737418240", v)
+		}
+
+		// A quota that can't be set rejects the config.
+		errQuota := errors.New("quota exceeded")
+		volumes.setProperties = func(name string, properties map[string]string) error {
+			return errQuota
+		}
+		failed := *s.config
+		failed.Quota = "1GiB"
+		failed.VolumeSize = "2GiB"
+		if err := s.Reload(ctx, &failed); !errors.Is(err, errQuota) {
+			t.Fatalf("want %v, got %v", errQuota, err)
+		}
+		if s.config.volumeSizeBytes != 1<<30 {
+			t.Errorf("want running config to be kept, got volume size %d", s.config.volumeSizeBytes)
+		}
+	})
+
+	t.Run("warm pool", func(t *testing.T) {
+		s, _ := newTestSnapshotter(t, &Config{})
+
+		config := *s.config
+		config.WarmPoolSize = 1
+		if err := s.Reload(ctx, &config); err != nil {
+			t.Fatal(err)
+		}
+		if s.warmPool == nil {
+			t.Fatal("want warm pool to be started")
+		}
+		waitForWarmPool(t, s.warmPool, 1)
+
+		disabled := *s.config
+		disabled.WarmPoolSize = 0
+		if err := s.Reload(ctx, &disabled); err != nil {
+			t.Fatal(err)
+		}
+		if s.warmPool != nil {
+			t.Error("want warm pool to be stopped")
+		}
+	})
+
+	t.Run("templates", func(t *testing.T) {
+		s, volumes := newTestSnapshotter(t, &Config{})
+
+		// Snapshots are created while the template of the new config is
+		// formatted.
+		formatting := make(chan struct{})
+		release := make(chan struct{})
+		volumes.mkfs = func(device string) error {
+			if strings.Contains(device, templatePrefix) {
+				close(formatting)
+				<-release
+			}
+			return nil
+		}
+
+		config := *s.config
+		config.BaseTemplate = true
+		reloaded := make(chan error, 1)
+		go func() {
+			reloaded <- s.Reload(ctx, &config)
+		}()
+		<-formatting
+
+		if _, err := s.Prepare(ctx, "active", ""); err != nil {
+			t.Fatal(err)
+		}
+		close(release)
+
+		if err := <-reloaded; err != nil {
+			t.Fatal(err)
+		}
+		if s.templates == nil {
+			t.Error("want base templates to be set up")
+		}
+	})
+
+	t.Run("concurrent mounts", func(t *testing.T) {
+		s, _ := newTestSnapshotter(t, &Config{})
+
+		if _, err := s.Prepare(ctx, "active", ""); err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan struct{})
+		errs := make(chan error, 1)
+		go func() {
+			defer close(errs)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := s.Mounts(ctx, "active"); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+
+		// Each reload replaces the config read by Mounts.
+		for range 1000 {
+			config := *s.config
+			if err := s.Reload(ctx, &config); err != nil {
+				t.Error(err)
+			}
+		}
+		close(done)
+
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("slow snapshot", func(t *testing.T) {
+		s, volumes := newTestSnapshotter(t, &Config{})
+
+		reached := make(chan struct{})
+		release := make(chan struct{})
+		var formatted atomic.Int32
+		volumes.mkfs = func(device string) error {
+			if formatted.Add(1) == 1 {
+				close(reached)
+				<-release
+			}
+			return nil
+		}
+
+		slow := make(chan error, 1)
+		go func() {
+			_, err := s.Prepare(ctx, "slow", "")
+			slow <- err
+		}()
+		<-reached
+
+		config := *s.config
+		config.VolumeSize = "2GiB"
+		reloaded := make(chan error, 1)
+		go func() {
+			reloaded <- s.Reload(ctx, &config)
+		}()
+
+		// The config is applied while the slow snapshot is being formatted.
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			s.configMu.RLock()
+			applied := s.config == &config
+			s.configMu.RUnlock()
+			if applied {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		prepared := make(chan error, 1)
+		go func() {
+			_, err := s.Prepare(ctx, "fast", "")
+			prepared <- err
+		}()
+		select {
+		case err := <-prepared:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("want snapshot prepared while reloading, got blocked")
+		}
+
+		// Reload waits for the slow snapshot before cleaning up.
+		select {
+		case err := <-reloaded:
+			t.Errorf("want reload to wait for the slow snapshot, got %v", err)
+		default:
+		}
+
+		close(release)
+		if err := <-slow; err != nil {
+			t.Fatal(err)
+		}
+		if err := <-reloaded; err != nil {
+			t.Fatal(err)
+		}
+
+		for id, size := range map[string]uint64{"1": 1 << 30, "2": 2 << 30} {
+			d, err := volumes.Get(ctx, testDataset+"/"+id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Volsize != size {
+				t.Errorf("want volume size %d of volume %s, got %d", size, id, d.Volsize)
+			}
+		}
+	})
+
+	t.Run("immutable fields", func(t *testing.T) {
+		s, _ := newTestSnapshotter(t, &Config{})
+
+		config := *s.config
+		config.Dataset = "tank/other"
+		config.VolumeSize = "2GiB"
+		if err := s.Reload(ctx, &config); !errdefs.IsInvalidArgument(err) {
+			t.Fatalf("want invalid argument error, got %v", err)
+		}
+		if s.config.Dataset != testDataset || s.config.volumeSizeBytes != 1<<30 {
+			t.Errorf("want running config to be kept, got dataset %q and volume size %d", s.config.Dataset, s.config.volumeSizeBytes)
+		}
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		s, _ := newTestSnapshotter(t, &Config{})
+
+		config := *s.config
+		config.FileSystemType = "btrfs"
+		if err := s.Reload(ctx, &config); !errdefs.IsInvalidArgument(err) {
+			t.Fatalf("want invalid argument error, got %v", err)
+		}
+		if s.config.FileSystemType != fsTypeExt4 {
+			t.Errorf("want file system type %q, got %q", fsTypeExt4, s.config.FileSystemType)
+		}
+	})
+
+	t.Run("check config", func(t *testing.T) {
+		s, _ := newTestSnapshotter(t, &Config{})
+
+		config := *s.config
+		config.VolumeSize = "2GiB"
+		if err := s.CheckConfig(ctx, &config); err != nil {
+			t.Fatal(err)
+		}
+		if s.config.volumeSizeBytes != 1<<30 {
+			t.Errorf("want checked config not to be applied, got volume size %d", s.config.volumeSizeBytes)
+		}
+
+		config.RootPath = t.TempDir()
+		if err := s.CheckConfig(ctx, &config); !errdefs.IsInvalidArgument(err) {
+			t.Errorf("want invalid argument error, got %v", err)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		s, _ := newTestSnapshotter(t, &Config{})
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		config := *s.config
+		if err := s.Reload(ctx, &config); !errdefs.IsUnavailable(err) {
+			t.Errorf("want unavailable error, got %v", err)
+		}
+	})
+}
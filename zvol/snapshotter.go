@@ -4,33 +4,58 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"math"
 	"os"
-	"os/exec"
-	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/containerd/containerd/v2/core/mount"
 	"github.com/containerd/containerd/v2/core/snapshots"
 	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
 	"github.com/containerd/log"
-	"github.com/mistifyio/go-zfs/v3"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-type fsType string
-
-const fsTypeExt4 fsType = "ext4"
-
 const (
 	// LabelVolumeSize is the label used for the volume size
 	LabelVolumeSize = "containerd.io/snapshot/zvol/size"
 
+	// LabelFileSystemType is the label used for the file system type. It can
+	// be set on snapshots without a parent, other snapshots always use the
+	// file system type of their parent.
+	LabelFileSystemType = "containerd.io/snapshot/zvol/fs-type"
+
+	// LabelBlockDevice is the label used to request the mounts of a snapshot
+	// to describe the raw block device instead of a file system mount.
+	LabelBlockDevice = "containerd.io/snapshot/zvol/block-device"
+
+	// MountOptionBlockDevice is the mount option marking the mounts of
+	// snapshots in block device mode. Runtimes key on it to attach the source
+	// to the guest instead of mounting it. Like other "x-" options it is not a
+	// file system option and must be removed before mounting the file system.
+	MountOptionBlockDevice = "x-zvol.block-device"
+
+	// LabelPropertyPrefix is the prefix of labels used to set ZFS properties
+	// on the volume of a snapshot, e.g.
+	// "containerd.io/snapshot/zvol/property.compression=zstd". Properties must
+	// be allowed in the config.
+	LabelPropertyPrefix = "containerd.io/snapshot/zvol/property."
+
 	zfsLabelPropertyPrefix    = "containerd:label."
 	zfsLabelPropertyMaxLength = 256
 
+	// zfsFsTypeProperty is the ZFS user property recording the file system
+	// type of a snapshot volume.
+	zfsFsTypeProperty = "containerd:fs_type"
+
 	zfsDevicePath = "/dev/zvol"
 
 	// snapshotSuffix is used as follows:
@@ -45,18 +70,81 @@ const (
 )
 
 type snapshotter struct {
-	dataset *zfs.Dataset
+	dataset *dataset
+	volumes volumeManager
 	store   *storage.MetaStore
 	config  *Config
+	// locks serializes operations on a snapshot key, so the volume of a
+	// snapshot is not used before it is created.
+	locks keyLocks
+	// warmPool keeps formatted volumes ready for new snapshots, nil when the
+	// warm pool is disabled.
+	warmPool *warmPool
+	// templates are cloned for new snapshots, nil when base templates are
+	// disabled.
+	templates *templates
+
+	// creating counts the snapshots being created with templates and
+	// warmPool, so Reload can wait for them before cleaning them up.
+	creating *sync.WaitGroup
+
+	// configMu guards config, warmPool, templates and creating against
+	// Reload. Operations using them hold it for reading while taking them.
+	configMu sync.RWMutex
+	// reloadMu serializes Reload, which sets up the templates and the warm
+	// pool of a new config before taking configMu.
+	reloadMu sync.Mutex
+
+	// calls runs the reads of metrics and health checks that don't honour
+	// their context in the background.
+	calls detachedCalls
+
+	// ops tracks the running operations that change volumes, so Close can
+	// wait for them before closing the metadata store.
+	ops    sync.WaitGroup
+	opsMu  sync.Mutex
+	closed bool
 }
 
 func NewSnapshotter(ctx context.Context, config *Config) (snapshots.Snapshotter, error) {
-	if err := config.parse(); err != nil {
+	if err := config.Parse(); err != nil {
+		return nil, err
+	}
+
+	volumes, err := newVolumeManager(config)
+	if err != nil {
+		return nil, err
+	}
+	volumes = &instrumentedVolumeManager{volumeManager: volumes, backend: config.Backend}
+
+	s, err := newSnapshotter(ctx, config, volumes)
+	if err != nil {
+		if c, ok := volumes.(io.Closer); ok {
+			c.Close()
+		}
 		return nil, err
 	}
 
-	dataset, err := zfs.GetDataset(config.Dataset)
+	is, err := newInstrumentedSnapshotter(s)
 	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return is, nil
+}
+
+func newSnapshotter(ctx context.Context, config *Config, volumes volumeManager) (*snapshotter, error) {
+	if err := config.Parse(); err != nil {
+		return nil, err
+	}
+
+	dataset, err := volumes.Get(ctx, config.Dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := volumes.CheckVolumeProperties(ctx, dataset.Name, config.volumeSizeBytes, createVolumeProperties(config.VolumeProperties)); err != nil {
 		return nil, err
 	}
 
@@ -70,14 +158,96 @@ func NewSnapshotter(ctx context.Context, config *Config) (snapshots.Snapshotter,
 	}
 
 	z := &snapshotter{
-		dataset: dataset,
-		store:   ms,
-		config:  config,
+		dataset:  dataset,
+		volumes:  volumes,
+		store:    ms,
+		config:   config,
+		creating: &sync.WaitGroup{},
+	}
+
+	if err := z.setQuota(ctx, config); err != nil {
+		ms.Close()
+		return nil, err
+	}
+
+	if err := z.reconcile(ctx); err != nil {
+		ms.Close()
+		return nil, err
+	}
+
+	if err := z.startEmptyVolumes(ctx); err != nil {
+		ms.Close()
+		return nil, err
 	}
 
 	return z, nil
 }
 
+// setQuota sets the quota of the dataset of the snapshotter to the quota of
+// a config, unless the config leaves it unchanged.
+func (s *snapshotter) setQuota(ctx context.Context, config *Config) error {
+	if config.quotaProperty == "" {
+		return nil
+	}
+	if err := s.volumes.SetProperties(ctx, s.dataset.Name, map[string]string{"quota": config.quotaProperty}); err != nil {
+		return fmt.Errorf("failed to set quota of dataset %s: %w", s.dataset.Name, err)
+	}
+	return nil
+}
+
+// startEmptyVolumes sets up the base templates and starts the warm pool for
+// the config of the snapshotter, if they are enabled.
+func (s *snapshotter) startEmptyVolumes(ctx context.Context) error {
+	t, err := s.setupTemplates(ctx, s.config)
+	if err != nil {
+		return err
+	}
+	s.templates = t
+	if s.templates != nil {
+		if err := s.templates.cleanup(ctx); err != nil {
+			return err
+		}
+	}
+
+	s.warmPool, err = s.startWarmPool(ctx, s.config, s.templates)
+	return err
+}
+
+// setupTemplates returns the base templates of a config with the template for
+// its volume size and file system type created, or nil when base templates
+// are disabled.
+func (s *snapshotter) setupTemplates(ctx context.Context, config *Config) (*templates, error) {
+	if !config.BaseTemplate {
+		return nil, nil
+	}
+
+	t := newTemplates(s, config)
+	if _, err := t.get(ctx, config.volumeSizeBytes, config.FileSystemType); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// startWarmPool starts the warm pool of a config, or returns nil when the warm
+// pool is disabled. Pool volumes are formatted with the config and templates
+// passed in, so the pool doesn't depend on the running config.
+func (s *snapshotter) startWarmPool(ctx context.Context, config *Config, t *templates) (*warmPool, error) {
+	if config.WarmPoolSize == 0 {
+		return nil, nil
+	}
+
+	p, err := newWarmPool(ctx, s, config, t)
+	if err != nil {
+		return nil, err
+	}
+	// The warm pool is refilled until the snapshotter is closed or the
+	// config is reloaded.
+	p.start(log.WithLogger(context.Background(), log.G(ctx)))
+	return p, nil
+}
+
+// zfsCreateVolumeProperties are the default properties for created volumes and
+// clones. They can be extended or overridden with the volume properties config.
 var zfsCreateVolumeProperties = map[string]string{
 	"refreservation": "none",
 	"volmode":        "full",
@@ -110,13 +280,51 @@ func (s *snapshotter) Stat(ctx context.Context, key string) (snapshots.Info, err
 func (s *snapshotter) Update(ctx context.Context, info snapshots.Info, fieldpaths ...string) (snapshots.Info, error) {
 	log.G(ctx).Debugf("update: %s", strings.Join(fieldpaths, ", "))
 
-	var err error
-	err = s.store.WithTransaction(ctx, true, func(ctx context.Context) error {
+	// Updates of the same snapshot are serialized, so the zfs properties are
+	// set in the order the metadata is updated.
+	s.locks.lock(info.Name)
+	defer s.locks.unlock(info.Name)
+
+	var (
+		id    string
+		props map[string]string
+	)
+	err := s.store.WithTransaction(ctx, true, func(ctx context.Context) error {
+		var (
+			old snapshots.Info
+			err error
+		)
+		id, old, _, err = storage.GetInfo(ctx, info.Name)
+		if err != nil {
+			return err
+		}
+
 		info, err = storage.UpdateInfo(ctx, info, fieldpaths...)
+		if err != nil {
+			return err
+		}
+
+		// The file system of the volume is created with the snapshot, the
+		// label recording it can't be changed afterwards.
+		if info.Labels[LabelFileSystemType] != old.Labels[LabelFileSystemType] {
+			return fmt.Errorf("label %s can't be changed: %w", LabelFileSystemType, errdefs.ErrInvalidArgument)
+		}
+
+		props, err = getZfsMetadataProperties(ctx, info)
 		return err
 	})
+	if err != nil {
+		return snapshots.Info{}, err
+	}
 
-	return info, err
+	// The properties are set once the metadata is committed, so a slow pool
+	// doesn't block other writers of the metadata store.
+	volumeName := filepath.Join(s.dataset.Name, id)
+	if err := s.volumes.SetProperties(ctx, volumeName, props); err != nil {
+		return snapshots.Info{}, fmt.Errorf("failed to record metadata on zfs volume %s: %w", volumeName, err)
+	}
+
+	return info, nil
 }
 
 // Usage returns the resource usage of an active or committed snapshot
@@ -130,6 +338,11 @@ func (s *snapshotter) Update(ctx context.Context, info snapshots.Info, fieldpath
 func (s *snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, error) {
 	log.G(ctx).WithField("key", key).Debug("usage")
 
+	// Wait for a snapshot being created, its volume only exists once the
+	// snapshot is returned.
+	s.locks.lock(key)
+	defer s.locks.unlock(key)
+
 	var (
 		usage snapshots.Usage
 		err   error
@@ -151,7 +364,7 @@ func (s *snapshotter) usage(ctx context.Context, key string) (snapshots.Usage, e
 
 	if info.Kind == snapshots.KindActive {
 		activeName := filepath.Join(s.dataset.Name, id)
-		sDataset, err := zfs.GetDataset(activeName)
+		sDataset, err := s.volumes.Get(ctx, activeName)
 		if err != nil {
 			return snapshots.Usage{}, err
 		}
@@ -177,13 +390,21 @@ func (s *snapshotter) usage(ctx context.Context, key string) (snapshots.Usage, e
 func (s *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
 	log.G(ctx).WithField("key", key).Debug("mounts")
 
+	s.locks.lock(key)
+	defer s.locks.unlock(key)
+
 	var (
 		snap storage.Snapshot
+		info snapshots.Info
 		err  error
 	)
 
 	err = s.store.WithTransaction(ctx, false, func(ctx context.Context) error {
 		snap, err = storage.GetSnapshot(ctx, key)
+		if err != nil {
+			return err
+		}
+		_, info, _, err = storage.GetInfo(ctx, key)
 		return err
 	})
 	if err != nil {
@@ -191,11 +412,29 @@ func (s *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, er
 	}
 
 	snapName := filepath.Join(s.dataset.Name, snap.ID)
-	snapDataset, err := zfs.GetDataset(snapName)
+	if _, err := s.volumes.Get(ctx, snapName); err != nil {
+		return nil, err
+	}
+
+	fs, err := s.getFsType(ctx, info.Labels, snapName)
 	if err != nil {
 		return nil, err
 	}
-	return getMounts(snapDataset, false), nil
+
+	s.configMu.RLock()
+	config := s.config
+	s.configMu.RUnlock()
+
+	blockDevice, err := isBlockDevice(config, info.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	readonly := snap.Kind == snapshots.KindView
+	if blockDevice {
+		return s.getBlockDeviceMounts(snapName, fs, readonly)
+	}
+	return s.getMounts(snapName, fs, readonly), nil
 }
 
 // Prepare creates an active snapshot identified by key descending from the
@@ -215,17 +454,12 @@ func (s *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, er
 func (s *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
 	log.G(ctx).WithFields(log.Fields{"key": key, "parent": parent}).Debug("prepare")
 
-	var (
-		mounts []mount.Mount
-		err    error
-	)
-
-	err = s.store.WithTransaction(ctx, true, func(ctx context.Context) error {
-		mounts, err = s.createSnapshot(ctx, snapshots.KindActive, key, parent, opts...)
-		return err
-	})
+	if err := s.begin(); err != nil {
+		return nil, err
+	}
+	defer s.ops.Done()
 
-	return mounts, err
+	return s.createSnapshot(ctx, snapshots.KindActive, key, parent, opts...)
 }
 
 // View behaves identically to Prepare except the result may not be
@@ -244,28 +478,116 @@ func (s *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 func (s *snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
 	log.G(ctx).WithFields(log.Fields{"key": key, "parent": parent}).Debug("view")
 
-	var (
-		mounts []mount.Mount
-		err    error
-	)
+	if err := s.begin(); err != nil {
+		return nil, err
+	}
+	defer s.ops.Done()
 
-	err = s.store.WithTransaction(ctx, true, func(ctx context.Context) error {
-		mounts, err = s.createSnapshot(ctx, snapshots.KindView, key, parent, opts...)
-		return err
-	})
+	return s.createSnapshot(ctx, snapshots.KindView, key, parent, opts...)
+}
 
-	return mounts, err
+// volumeRequest describes the volume of a snapshot reserved in the metadata
+// store.
+type volumeRequest struct {
+	kind snapshots.Kind
+	id   string
+	// parentID is the id of the parent snapshot, empty for a new volume.
+	parentID    string
+	size        uint64
+	fs          fsType
+	blockDevice bool
+	// labelProperties are the zfs properties requested by labels.
+	labelProperties map[string]string
+	// userProperties are the zfs user properties recording the file system
+	// type, labels and metadata of the snapshot.
+	userProperties map[string]string
 }
 
+// createSnapshot creates a snapshot in three phases, so slow zfs and file
+// system operations don't hold the write transaction of the metadata store
+// and independent snapshots can be created in parallel:
+//
+//   - reserve: the snapshot is added to the metadata store.
+//   - create: the volume of the snapshot is created or cloned.
+//   - finalize: the snapshot is removed from the metadata store again when
+//     its volume could not be created.
+//
+// The key stays locked until the snapshot is finalized. The reservation is
+// recorded until then, so a crash before the volume is created leaves an
+// unfinished snapshot, which is removed by reconcile.
+//
+// The snapshot is created with the config, templates and warm pool at the
+// time it is reserved. configMu is only held while taking them, so a Reload
+// doesn't wait for slow zfs and mkfs operations and doesn't block other
+// snapshots in the meantime.
 func (s *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
-	volSize := s.config.volumeSizeBytes
+	s.locks.lock(key)
+	defer s.locks.unlock(key)
+
+	s.configMu.RLock()
+	config, t, pool, creating := s.config, s.templates, s.warmPool, s.creating
+	creating.Add(1)
+	s.configMu.RUnlock()
+	defer creating.Done()
+
+	var req *volumeRequest
+	tctx, span := startSpan(ctx, "metadata.reserve")
+	err := withBoltTransaction(tctx, s.store, true, func(ctx context.Context, tx *bolt.Tx) error {
+		var err error
+		req, err = s.reserveSnapshot(ctx, config, kind, key, parent, opts...)
+		if err != nil {
+			return err
+		}
+		return markReserved(tx, req.id)
+	})
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts, err := s.createVolume(ctx, config, t, pool, req)
+
+	// The metadata must be finalized even when the request was canceled.
+	fctx, span := startSpan(context.WithoutCancel(ctx), "metadata.finalize")
+	ferr := withBoltTransaction(fctx, s.store, true, func(ctx context.Context, tx *bolt.Tx) error {
+		if err != nil {
+			if _, _, err := storage.Remove(ctx, key); err != nil {
+				return err
+			}
+		}
+		return clearReserved(tx, req.id)
+	})
+	endSpan(span, ferr)
+	if ferr != nil {
+		log.G(ctx).WithError(ferr).Errorf("failed to finalize metadata of snapshot %s", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return mounts, nil
+}
+
+// reserveSnapshot adds the snapshot to the metadata store and returns the
+// volume to create for it with a config. It must be called in a write
+// transaction.
+func (s *snapshotter) reserveSnapshot(ctx context.Context, config *Config, kind snapshots.Kind, key, parent string, opts ...snapshots.Opt) (*volumeRequest, error) {
+	volSize := config.volumeSizeBytes
+	fs := config.FileSystemType
 	if len(parent) > 0 {
-		_, snapInfo, _, err := storage.GetInfo(ctx, parent)
+		parentID, snapInfo, _, err := storage.GetInfo(ctx, parent)
 		if err != nil {
 			log.G(ctx).Errorf("failed to read snapshotInfo for %s", parent)
 			return nil, err
 		}
 
+		// Snapshots always use the file system of their parent.
+		fs, err = s.getFsType(ctx, snapInfo.Labels, filepath.Join(s.dataset.Name, parentID+"@"+snapshotSuffix))
+		if err != nil {
+			log.G(ctx).Errorf("failed to get file system type for %s", parent)
+			return nil, err
+		}
+
 		if v, ok := snapInfo.Labels[LabelVolumeSize]; ok {
 			volSize, err = strconv.ParseUint(v, 10, 64)
 			if err != nil {
@@ -290,100 +612,299 @@ func (s *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 		volSize = val
 	}
 
-	labels[LabelVolumeSize] = fmt.Sprintf("%d", volSize)
+	if v, ok := labels[LabelFileSystemType]; ok {
+		val, err := parseFsType(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file system type for snapshot %s: %w: %w", key, err, errdefs.ErrInvalidArgument)
+		}
+
+		if len(parent) > 0 && val != fs {
+			return nil, fmt.Errorf("conflicting file system type %q for snapshot %s, must match parent file system type %q: %w", val, key, fs, errdefs.ErrInvalidArgument)
+		}
 
-	opts = append(opts, WithVolumeSize(volSize))
+		fs = val
+	}
 
-	snap, err := storage.CreateSnapshot(ctx, kind, key, parent, opts...)
+	blockDevice, err := isBlockDevice(config, labels)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid block device mode for snapshot %s: %w: %w", key, err, errdefs.ErrInvalidArgument)
 	}
 
-	targetName := filepath.Join(s.dataset.Name, snap.ID)
-	var target *zfs.Dataset
-	if len(snap.ParentIDs) == 0 {
-		log.G(ctx).Debugf("creating new zfs volume '%s'", targetName)
+	labelProperties, err := getLabelProperties(labels, config.AllowedLabelProperties, len(parent) > 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid zfs properties for snapshot %s: %w", key, err)
+	}
 
-		target, err = zfs.CreateVolume(targetName, volSize, zfsCreateVolumeProperties)
-		if err != nil {
-			log.G(ctx).WithError(err).Errorf("failed to create zfs volume for snapshot %s", snap.ID)
-			return nil, err
-		}
-		devicePath := getDevicePath(target)
+	labels[LabelVolumeSize] = fmt.Sprintf("%d", volSize)
+	labels[LabelFileSystemType] = string(fs)
 
-		// Wait for Zvol symlinks to be created under /dev/zvol.
-		waitForFile(ctx, devicePath)
+	opts = append(opts, WithVolumeSize(volSize), withFileSystemType(fs))
 
-		// ext4 options taken from device mapper.
-		// Explicitly disable lazy_itable_init and lazy_journal_init in order to enable lazy initialization.
-		fsOptions := "nodiscard,lazy_itable_init=0,lazy_journal_init=0"
-		log.G(ctx).Debugf("creating file system of type: %s with options: %s on zfs volume %q", fsTypeExt4, fsOptions, target.Name)
-		if err := mkfs(ctx, fsTypeExt4, fsOptions, devicePath); err != nil {
-			errs := []error{err}
+	snap, err := storage.CreateSnapshot(ctx, kind, key, parent, opts...)
+	if err != nil {
+		return nil, err
+	}
 
-			// Rollback zfs volume creation if mkfs failed
-			errs = append(errs, target.Destroy(zfs.DestroyDefault))
+	_, info, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 
-			log.G(ctx).WithError(errors.Join(errs...)).Errorf("failed to initialize zfs volume %q for snapshot %s", target.Name, snap.ID)
-			return nil, errors.Join(errs...)
-		}
+	// User properties are set when the volume is created, a new snapshot is
+	// born with its file system type, labels and metadata.
+	userProperties, err := getZfsMetadataProperties(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	maps.Copy(userProperties, getZfsLabelProperties(ctx, labels))
+	userProperties[zfsFsTypeProperty] = string(fs)
+
+	req := &volumeRequest{
+		kind:            kind,
+		id:              snap.ID,
+		size:            volSize,
+		fs:              fs,
+		blockDevice:     blockDevice,
+		labelProperties: labelProperties,
+		userProperties:  userProperties,
+	}
+	if len(snap.ParentIDs) > 0 {
+		req.parentID = snap.ParentIDs[0]
+	}
 
-		readonly := false
-		mounts := getMounts(target, readonly)
+	return req, nil
+}
 
-		// Remove default directories not expected by the container image
-		_ = mount.WithTempMount(ctx, mounts, func(root string) error {
-			return os.Remove(filepath.Join(root, "lost+found"))
-		})
+// createVolume creates the volume of a reserved snapshot with a config, its
+// templates and warm pool, and returns its mounts. It is called outside of a
+// transaction.
+func (s *snapshotter) createVolume(ctx context.Context, config *Config, t *templates, pool *warmPool, req *volumeRequest) ([]mount.Mount, error) {
+	var (
+		target     *dataset
+		err        error
+		targetName = filepath.Join(s.dataset.Name, req.id)
+		fs         = req.fs
+		volSize    = req.size
+	)
+	if req.parentID == "" && pool != nil && pool.matches(req) {
+		target, err = s.takeWarmVolume(ctx, pool, targetName, req)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		if err := setZfsLabelProperties(ctx, target, labels); err != nil {
+	if target != nil {
+		// Wait for Zvol symlinks to be moved to the new name.
+		waitForFile(ctx, s.volumes.DevicePath(target.Name))
+	} else if req.parentID == "" {
+		target, err = s.createEmptyVolume(ctx, config, t, targetName, volSize, fs, req.labelProperties, req.userProperties)
+		if err != nil {
+			log.G(ctx).WithError(err).Errorf("failed to create zfs volume for snapshot %s", req.id)
 			return nil, err
 		}
 	} else {
-		parent0Name := filepath.Join(s.dataset.Name, snap.ParentIDs[0]+"@"+snapshotSuffix)
-		parent0, err := zfs.GetDataset(parent0Name)
+		target, err = s.cloneVolume(ctx, config, req, targetName)
 		if err != nil {
 			return nil, err
 		}
-		target, err = parent0.Clone(targetName, zfsCreateVolumeProperties)
+	}
+
+	readonly := req.kind == snapshots.KindView
+	if req.blockDevice {
+		mounts, err := s.getBlockDeviceMounts(target.Name, fs, readonly)
 		if err != nil {
+			// Rollback zfs volume creation, even when the request was canceled
+			return nil, errors.Join(err, s.volumes.Destroy(context.WithoutCancel(ctx), target.Name, destroyDefault))
+		}
+		return mounts, nil
+	}
+	return s.getMounts(target.Name, fs, readonly), nil
+}
+
+// cloneVolume clones the volume of the parent snapshot and grows the clone
+// and its file system to the requested size. The clone is destroyed when it
+// can't be grown.
+func (s *snapshotter) cloneVolume(ctx context.Context, config *Config, req *volumeRequest, name string) (_ *dataset, retErr error) {
+	parent0Name := filepath.Join(s.dataset.Name, req.parentID+"@"+snapshotSuffix)
+	parent0, err := s.volumes.Get(ctx, parent0Name)
+	if err != nil {
+		return nil, err
+	}
+	target, err := s.volumes.Clone(ctx, parent0.Name, name, cloneVolumeProperties(config.VolumeProperties, req.labelProperties, req.userProperties))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if retErr == nil {
+			return
+		}
+		// Rollback zfs clone, even when the request was canceled
+		retErr = errors.Join(retErr, s.volumes.Destroy(context.WithoutCancel(ctx), target.Name, destroyDefault))
+		log.G(ctx).WithError(retErr).Errorf("failed to resize zfs volume %q for snapshot %s", target.Name, req.id)
+	}()
+
+	// Resize target if required
+	resized := false
+	if req.size > 0 && parent0.Volsize != req.size {
+		if err := s.volumes.SetProperties(ctx, target.Name, map[string]string{"volsize": fmt.Sprintf("%d", req.size)}); err != nil {
+			return nil, err
+		}
+		resized = true
+	}
+
+	// Wait for Zvol symlinks to be created under /dev/zvol.
+	devicePath := s.volumes.DevicePath(target.Name)
+	waitForFile(ctx, devicePath)
+
+	// Grow the file system so the additional volume space can actually be used.
+	if resized {
+		log.G(ctx).Debugf("resizing file system of type: %s on zfs volume %q", req.fs, target.Name)
+		if err := s.volumes.Resizefs(ctx, req.fs, devicePath); err != nil {
 			return nil, err
 		}
+	}
+
+	return target, nil
+}
 
-		// Resize target if required
-		if volSize > 0 && parent0.Volsize != volSize {
-			if err := target.SetProperty("volsize", fmt.Sprintf("%d", volSize)); err != nil {
+// createEmptyVolume creates a volume with an empty file system for a config.
+// The volume is cloned from a template when base templates are enabled, unless
+// properties that can only be set when creating a volume are requested by
+// labels.
+func (s *snapshotter) createEmptyVolume(ctx context.Context, config *Config, t *templates, name string, size uint64, fs fsType, labelProperties, userProperties map[string]string) (*dataset, error) {
+	if t != nil && !slices.ContainsFunc(slices.Collect(maps.Keys(labelProperties)), isCreateOnlyProperty) {
+		template, err := t.get(ctx, size, fs)
+		if err == nil {
+			log.G(ctx).Debugf("cloning template %s to zfs volume '%s'", template, name)
+
+			target, err := s.volumes.Clone(ctx, template, name, cloneVolumeProperties(config.VolumeProperties, labelProperties, userProperties))
+			if err != nil {
+				t.forget(template)
 				return nil, err
 			}
+
+			// Wait for Zvol symlinks to be created under /dev/zvol.
+			waitForFile(ctx, s.volumes.DevicePath(target.Name))
+			return target, nil
 		}
+		log.G(ctx).WithError(err).Warnf("failed to get template, creating new zfs volume '%s'", name)
+	}
 
-		// Wait for Zvol symlinks to be created under /dev/zvol.
-		devicePath := getDevicePath(target)
-		waitForFile(ctx, devicePath)
+	log.G(ctx).Debugf("creating new zfs volume '%s'", name)
 
-		if err := setZfsLabelProperties(ctx, target, labels); err != nil {
-			return nil, err
+	target, err := s.volumes.CreateVolume(ctx, name, size, createVolumeProperties(config.VolumeProperties, labelProperties, userProperties))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.formatVolume(ctx, target.Name, fs); err != nil {
+		errs := []error{err}
+
+		// Rollback zfs volume creation if mkfs failed
+		errs = append(errs, s.volumes.Destroy(ctx, target.Name, destroyDefault))
+
+		log.G(ctx).WithError(errors.Join(errs...)).Errorf("failed to initialize zfs volume %q", target.Name)
+		return nil, errors.Join(errs...)
+	}
+
+	return target, nil
+}
+
+// formatVolume creates a file system on a new volume.
+func (s *snapshotter) formatVolume(ctx context.Context, name string, fs fsType) error {
+	devicePath := s.volumes.DevicePath(name)
+
+	// Wait for Zvol symlinks to be created under /dev/zvol.
+	waitForFile(ctx, devicePath)
+
+	log.G(ctx).Debugf("creating file system of type: %s on zfs volume %q", fs, name)
+	if err := s.volumes.Mkfs(ctx, fs, devicePath); err != nil {
+		return err
+	}
+
+	readonly := false
+	mounts := s.getMounts(name, fs, readonly)
+
+	// Remove default directories not expected by the container image
+	_ = s.volumes.Cleanupfs(ctx, fs, mounts)
+
+	return nil
+}
+
+// takeWarmVolume renames a formatted volume from a warm pool to the volume
+// of a snapshot. It returns nil when the warm pool is empty or the volume
+// could not be renamed.
+func (s *snapshotter) takeWarmVolume(ctx context.Context, pool *warmPool, targetName string, req *volumeRequest) (*dataset, error) {
+	name, ok := pool.take()
+	if !ok {
+		log.G(ctx).Debugf("warm pool is empty, creating new zfs volume for snapshot %s", req.id)
+		return nil, nil
+	}
+
+	if err := s.volumes.Rename(ctx, name, targetName); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to rename warm pool volume %s", name)
+		if err := s.volumes.Destroy(ctx, name, destroyDefault); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to destroy warm pool volume %s", name)
 		}
+		return nil, nil
 	}
+	log.G(ctx).Debugf("renamed warm pool volume %s to %s", name, targetName)
 
-	readonly := kind == snapshots.KindView
-	return getMounts(target, readonly), nil
+	if err := s.volumes.SetProperties(ctx, targetName, req.userProperties); err != nil {
+		return nil, errors.Join(err, s.volumes.Destroy(ctx, targetName, destroyDefault))
+	}
+
+	return &dataset{Name: targetName, Type: datasetVolume, Volsize: req.size}, nil
 }
 
-func getMounts(dataset *zfs.Dataset, readonly bool) []mount.Mount {
-	var options []string
-	if readonly {
-		options = append(options, "ro")
+// isBlockDevice reports whether the mounts of a snapshot describe the raw
+// block device, either requested by label or enabled in the config.
+func isBlockDevice(config *Config, labels map[string]string) (bool, error) {
+	if v, ok := labels[LabelBlockDevice]; ok {
+		return strconv.ParseBool(v)
 	}
+	return config.BlockDevice, nil
+}
+
+func (s *snapshotter) getMounts(name string, fs fsType, readonly bool) []mount.Mount {
 	return []mount.Mount{
 		{
-			Type:    fmt.Sprint(fsTypeExt4), // TODO: get fs type from dataset attributes
-			Source:  getDevicePath(dataset),
-			Options: options,
+			Type:    string(fs),
+			Source:  s.volumes.DevicePath(name),
+			Options: mountOptions(fs, readonly),
 		},
 	}
 }
 
+// getBlockDeviceMounts returns mounts describing the zfs volume as a raw block
+// device for VM based runtimes, like Kata Containers and firecracker-containerd,
+// that pass the device through to the guest instead of mounting it on the host.
+// The source is the device node backing the volume, the type is the file
+// system the guest should mount and the options carry MountOptionBlockDevice.
+func (s *snapshotter) getBlockDeviceMounts(name string, fs fsType, readonly bool) ([]mount.Mount, error) {
+	devicePath, err := filepath.EvalSymlinks(s.volumes.DevicePath(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve device for zfs volume %q: %w", name, err)
+	}
+
+	fi, err := os.Stat(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return nil, fmt.Errorf("%s is not a block device", devicePath)
+	}
+
+	return []mount.Mount{
+		{
+			Type:    string(fs),
+			Source:  devicePath,
+			Options: append(mountOptions(fs, readonly), MountOptionBlockDevice),
+		},
+	}, nil
+}
+
 // Commit captures the changes between key and its parent into a snapshot
 // identified by name.  The name can then be used with the snapshotter's other
 // methods to create subsequent snapshots.
@@ -395,63 +916,178 @@ func getMounts(dataset *zfs.Dataset, readonly bool) []mount.Mount {
 func (s *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
 	log.G(ctx).WithFields(log.Fields{"name": name, "key": key}).Debug("commit")
 
-	return s.store.WithTransaction(ctx, true, func(ctx context.Context) error {
-		_, snapInfo, _, err := storage.GetInfo(ctx, key)
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.ops.Done()
+
+	// The name is locked as well, so commits to the same name are
+	// serialized. Keys are locked in order to avoid deadlocks.
+	keys := []string{key, name}
+	slices.Sort(keys)
+	for _, k := range slices.Compact(keys) {
+		s.locks.lock(k)
+		defer s.locks.unlock(k)
+	}
+
+	var (
+		id     string
+		active snapshots.Info
+		usage  snapshots.Usage
+		props  map[string]string
+	)
+	tctx, span := startSpan(ctx, "metadata.get")
+	err := s.store.WithTransaction(tctx, false, func(ctx context.Context) error {
+		var err error
+		id, active, _, err = storage.GetInfo(ctx, key)
 		if err != nil {
 			return err
 		}
+		if active.Kind != snapshots.KindActive {
+			return fmt.Errorf("snapshot %q is not active: %w", key, errdefs.ErrFailedPrecondition)
+		}
+		if _, _, _, err := storage.GetInfo(ctx, name); err == nil {
+			return fmt.Errorf("committed snapshot %v: %w", name, errdefs.ErrAlreadyExists)
+		} else if !errdefs.IsNotFound(err) {
+			return err
+		}
 
-		usage, err := s.usage(ctx, key)
+		usage, err = s.usage(ctx, key)
 		if err != nil {
 			return err
 		}
 
-		volSizeLabel := snapInfo.Labels[LabelVolumeSize]
-		if volSizeLabel != "" {
-			labels := make(map[string]string)
+		labels := make(map[string]string)
+		if volSizeLabel := active.Labels[LabelVolumeSize]; volSizeLabel != "" {
 			labels[LabelVolumeSize] = volSizeLabel
+		}
+		if fsTypeLabel := active.Labels[LabelFileSystemType]; fsTypeLabel != "" {
+			labels[LabelFileSystemType] = fsTypeLabel
+		}
+		if len(labels) > 0 {
 			opts = append(opts, snapshots.WithLabels(labels))
 		}
 
 		labelOpts := getLabelOpts(opts...)
-		allLabels := make(map[string]string, len(snapInfo.Labels)+len(labelOpts))
-		for key, value := range snapInfo.Labels {
+		allLabels := make(map[string]string, len(active.Labels)+len(labelOpts))
+		for key, value := range active.Labels {
 			allLabels[key] = value
 		}
 		for key, value := range labelOpts {
 			allLabels[key] = value
 		}
 
-		id, err := storage.CommitActive(ctx, key, name, usage, opts...)
+		// The committed snapshot replaces the labels of the active snapshot
+		// with the labels of the options, like storage.CommitActive.
+		now := time.Now().UTC()
+		props, err = getZfsMetadataProperties(ctx, snapshots.Info{
+			Kind:    snapshots.KindCommitted,
+			Name:    name,
+			Parent:  active.Parent,
+			Labels:  labelOpts,
+			Created: now,
+			Updated: now,
+		})
 		if err != nil {
 			return err
 		}
+		maps.Copy(props, getZfsLabelProperties(ctx, allLabels))
+		return nil
+	})
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
 
-		activeName := filepath.Join(s.dataset.Name, id)
-		active, err := zfs.GetDataset(activeName)
-		if err != nil {
+	// After committing the snapshot volume will not be directly
+	// used anymore. Setting volmode to none ensures the volume is not exposed outside of ZFS.
+	// It can still be snapshotted and cloned. A crash before the metadata is
+	// finalized leaves an interrupted commit that is rolled back by reconcile
+	// with the repair policy, or finished when the commit is retried.
+	activeName := filepath.Join(s.dataset.Name, id)
+	if s.interruptedCommit(ctx, activeName, props) {
+		if err := s.finishCommit(ctx, activeName, props); err != nil {
 			return err
 		}
+	} else if _, err := s.volumes.Commit(ctx, activeName, snapshotSuffix, props); err != nil {
+		return err
+	}
 
-		if len(allLabels) > 0 {
-			if err := setZfsLabelProperties(ctx, active, allLabels); err != nil {
-				return err
-			}
+	tctx, span = startSpan(ctx, "metadata.finalize")
+	err = s.store.WithTransaction(tctx, true, func(ctx context.Context) error {
+		_, err := storage.CommitActive(ctx, key, name, usage, opts...)
+		return err
+	})
+	endSpan(span, err)
+	if err != nil {
+		// The ZFS commit must be rolled back even when the request was
+		// canceled, so the commit can be retried.
+		ctx := context.WithoutCancel(ctx)
+		activeProps, perr := getZfsMetadataProperties(ctx, active)
+		if perr == nil {
+			perr = s.rollbackCommit(ctx, id, activeProps)
 		}
-
-		if _, err := active.Snapshot(snapshotSuffix, false); err != nil {
-			return err
+		if perr != nil {
+			log.G(ctx).WithError(perr).Errorf("failed to roll back commit of snapshot %s", key)
 		}
+		return err
+	}
 
-		// After committing the snapshot volume will not be directly
-		// used anymore. Setting volmode to none ensures the volume is not exposed outside of ZFS.
-		// It can still be snapshotted and cloned.
-		if err := active.SetProperty("volmode", "none"); err != nil {
-			return err
+	return nil
+}
+
+// interruptedCommit reports whether a volume is left committed by an
+// interrupted commit with the same key and parent: the zfs snapshot exists and
+// the volume records the metadata of the commit.
+func (s *snapshotter) interruptedCommit(ctx context.Context, volume string, properties map[string]string) bool {
+	if _, err := s.volumes.Get(ctx, volume+"@"+snapshotSuffix); err != nil {
+		return false
+	}
+	for _, property := range []string{zfsMetadataKindProperty, zfsMetadataKeyProperty, zfsMetadataParentProperty} {
+		if v, err := s.volumes.GetProperty(ctx, volume, property); err != nil || v != properties[property] {
+			return false
 		}
+	}
+	return true
+}
 
-		return nil
-	})
+// finishCommit finishes an interrupted commit of a volume. The zfs snapshot is
+// kept, the properties of the commit are set again and the volume is hidden.
+func (s *snapshotter) finishCommit(ctx context.Context, volume string, properties map[string]string) error {
+	log.G(ctx).Infof("finishing interrupted commit of zfs volume %s", volume)
+
+	props := maps.Clone(properties)
+	if props == nil {
+		props = make(map[string]string)
+	}
+	props["volmode"] = "none"
+	if err := s.volumes.SetProperties(ctx, volume, props); err != nil {
+		return fmt.Errorf("failed to finish commit of zfs volume %s: %w", volume, err)
+	}
+	return nil
+}
+
+// rollbackCommit destroys the zfs snapshot of a snapshot that could not be
+// committed and exposes its volume again. The properties, like the metadata
+// of the active snapshot, are restored on the volume.
+func (s *snapshotter) rollbackCommit(ctx context.Context, id string, properties map[string]string) error {
+	snapshotName := filepath.Join(s.dataset.Name, id+"@"+snapshotSuffix)
+	if err := s.volumes.Destroy(ctx, snapshotName, destroyDefault); err != nil {
+		return fmt.Errorf("failed to destroy zfs snapshot %s: %w", snapshotName, err)
+	}
+
+	// Commit sets the volume mode to none after taking the snapshot.
+	props := maps.Clone(properties)
+	if props == nil {
+		props = make(map[string]string)
+	}
+	props["volmode"] = zfsCreateVolumeProperties["volmode"]
+
+	volumeName := filepath.Join(s.dataset.Name, id)
+	if err := s.volumes.SetProperties(ctx, volumeName, props); err != nil {
+		return fmt.Errorf("failed to restore volmode of zfs volume %s: %w", volumeName, err)
+	}
+	return nil
 }
 
 // Remove the committed or active snapshot by the provided key.
@@ -463,10 +1099,19 @@ func (s *snapshotter) Commit(ctx context.Context, name, key string, opts ...snap
 func (s *snapshotter) Remove(ctx context.Context, key string) error {
 	log.G(ctx).WithField("key", key).Debug("remove")
 
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.ops.Done()
+
+	s.locks.lock(key)
+	defer s.locks.unlock(key)
+
 	// First, get the snapshot info before removing metadata
 	var id string
 	var k snapshots.Kind
-	err := s.store.WithTransaction(ctx, false, func(ctx context.Context) error {
+	tctx, span := startSpan(ctx, "metadata.get")
+	err := s.store.WithTransaction(tctx, false, func(ctx context.Context) error {
 		var err error
 		var info snapshots.Info
 		id, info, _, err = storage.GetInfo(ctx, key)
@@ -474,8 +1119,17 @@ func (s *snapshotter) Remove(ctx context.Context, key string) error {
 			return err
 		}
 		k = info.Kind
-		return nil
+
+		// Check for children before destroying anything, destroying the zfs
+		// snapshot of a parent would only mark it for deferred destruction.
+		return storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+			if info.Parent == key {
+				return fmt.Errorf("cannot remove snapshot with child: %w", errdefs.ErrFailedPrecondition)
+			}
+			return nil
+		})
 	})
+	endSpan(span, err)
 	if err != nil {
 		return fmt.Errorf("failed to get snapshot info: %w", err)
 	}
@@ -486,12 +1140,11 @@ func (s *snapshotter) Remove(ctx context.Context, key string) error {
 	// This ensures we don't lose track of volumes if destroy fails
 	if k == snapshots.KindCommitted {
 		snapshotName := datasetName + "@" + snapshotSuffix
-		snapshot, err := zfs.GetDataset(snapshotName)
-		if err != nil {
+		if _, err := s.volumes.Get(ctx, snapshotName); err != nil {
 			// Snapshot might already be destroyed, log and continue
 			log.G(ctx).WithError(err).Warnf("ZFS snapshot %s not found, may already be destroyed", snapshotName)
 		} else {
-			if err = snapshot.Destroy(zfs.DestroyDeferDeletion); err != nil {
+			if err = s.volumes.Destroy(ctx, snapshotName, destroyDeferDeletion); err != nil {
 				log.G(ctx).WithError(err).Errorf("failed to destroy ZFS snapshot %s", snapshotName)
 				return fmt.Errorf("failed to destroy ZFS snapshot %s: %w", snapshotName, err)
 			}
@@ -500,12 +1153,11 @@ func (s *snapshotter) Remove(ctx context.Context, key string) error {
 	}
 
 	// Destroy the dataset (volume) for both active and committed snapshots
-	dataset, err := zfs.GetDataset(datasetName)
-	if err != nil {
+	if _, err := s.volumes.Get(ctx, datasetName); err != nil {
 		// Dataset might already be destroyed, which is fine
 		log.G(ctx).WithError(err).Debugf("ZFS dataset %s not found, may already be destroyed", datasetName)
 	} else {
-		if err = dataset.Destroy(zfs.DestroyDefault); err != nil {
+		if err = s.volumes.Destroy(ctx, datasetName, destroyDefault); err != nil {
 			log.G(ctx).WithError(err).Errorf("failed to destroy ZFS dataset %s", datasetName)
 			return fmt.Errorf("failed to destroy ZFS dataset %s: %w", datasetName, err)
 		}
@@ -513,13 +1165,87 @@ func (s *snapshotter) Remove(ctx context.Context, key string) error {
 	}
 
 	// Now remove metadata only after ZFS resources are destroyed
-	return s.store.WithTransaction(ctx, true, func(ctx context.Context) error {
+	ctx, span = startSpan(ctx, "metadata.remove")
+	err = s.store.WithTransaction(ctx, true, func(ctx context.Context) error {
 		_, _, err := storage.Remove(ctx, key)
 		if err != nil {
 			return fmt.Errorf("failed to remove snapshot metadata: %w", err)
 		}
 		return nil
 	})
+	endSpan(span, err)
+	return err
+}
+
+// Cleanup cleans up disk resources from removed or abandoned snapshots.
+//
+// ZFS volumes under the snapshotter dataset without snapshot metadata are
+// destroyed. These are left behind when creating a snapshot fails half way or
+// when a snapshot could not be destroyed because it still had clones.
+func (s *snapshotter) Cleanup(ctx context.Context) error {
+	log.G(ctx).Debug("cleanup")
+
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.ops.Done()
+
+	// The volumes are listed before the metadata. Volumes are created after
+	// their snapshot is added to the metadata store and destroyed before it
+	// is removed, so a listed volume without metadata is abandoned or is being
+	// destroyed by a concurrent remove.
+	zvols, err := s.listZvols(ctx)
+	if err != nil {
+		return err
+	}
+
+	var snaps []metadataSnapshot
+	err = s.store.WithTransaction(ctx, false, func(ctx context.Context) error {
+		snaps, err = listMetadataSnapshots(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	report := newReconcileReport(zvols, snaps)
+
+	var errs []error
+	for _, id := range report.orphans {
+		state := report.zvols[id]
+		if err := s.destroyOrphan(ctx, state); err != nil && s.zvolExists(ctx, state) {
+			errs = append(errs, err)
+		}
+	}
+
+	// A running Reload cleans up the templates once the snapshots using the
+	// previous templates are created.
+	if s.reloadMu.TryLock() {
+		s.configMu.RLock()
+		t := s.templates
+		s.configMu.RUnlock()
+
+		if t != nil {
+			errs = append(errs, t.cleanup(ctx))
+		}
+		s.reloadMu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// zvolExists reports whether the volume or the zfs snapshot of a zvol still
+// exists.
+func (s *snapshotter) zvolExists(ctx context.Context, state *zvolState) bool {
+	for _, d := range []*dataset{state.snapshot, state.volume} {
+		if d == nil {
+			continue
+		}
+		if _, err := s.volumes.Get(ctx, d.Name); err == nil {
+			return true
+		}
+	}
+	return false
 }
 
 // Walk will call the provided function for each snapshot in the
@@ -545,37 +1271,46 @@ func (s *snapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, filters .
 // but not mandatory.
 //
 // Close returns nil when it is already closed.
+//
+// Operations started before Close are waited for, so a volume is not left
+// half created or committed. Operations started afterwards fail.
 func (s *snapshotter) Close() error {
 	log.L.Debug("close")
 
-	return s.store.Close()
-}
+	s.opsMu.Lock()
+	if s.closed {
+		s.opsMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.opsMu.Unlock()
 
-func getDevicePath(dataset *zfs.Dataset) string {
-	return path.Join(zfsDevicePath, dataset.Name)
-}
+	s.ops.Wait()
 
-// mkfs creates a filesystem on the given zfs volume
-func mkfs(ctx context.Context, fs fsType, fsOptions string, path string) error {
-	if fs != fsTypeExt4 {
-		return errors.New("file system not supported")
+	s.configMu.Lock()
+	if s.warmPool != nil {
+		s.warmPool.close()
 	}
+	s.configMu.Unlock()
 
-	command := "mkfs.ext4"
-	args := []string{
-		"-E",
-		fsOptions,
-		path,
+	var errs []error
+	if c, ok := s.volumes.(io.Closer); ok {
+		errs = append(errs, c.Close())
 	}
+	errs = append(errs, s.store.Close())
+	return errors.Join(errs...)
+}
 
-	log.G(ctx).Debugf("%s %s", command, strings.Join(args, " "))
-	o, err := exec.Command(command, args...).CombinedOutput()
-	out := string(o)
-	if err != nil {
-		return fmt.Errorf("%s failed to initialize %q: %s: %w", command, path, out, err)
-	}
+// begin registers an operation that changes volumes. The operation must call
+// s.ops.Done when it returns.
+func (s *snapshotter) begin() error {
+	s.opsMu.Lock()
+	defer s.opsMu.Unlock()
 
-	log.G(ctx).Debugf("mkfs:\n%s", out)
+	if s.closed {
+		return fmt.Errorf("snapshotter is closed: %w", errdefs.ErrUnavailable)
+	}
+	s.ops.Add(1)
 	return nil
 }
 
@@ -584,6 +1319,9 @@ func waitForFile(ctx context.Context, filePath string) {
 		return
 	}
 
+	ctx, span := startSpan(ctx, "device.wait", attribute.String("device.path", filePath))
+	defer span.End()
+
 	ticker := time.NewTicker(5 * time.Millisecond)
 	defer ticker.Stop()
 	for {
@@ -610,6 +1348,36 @@ func WithVolumeSize(size uint64) snapshots.Opt {
 	}
 }
 
+func withFileSystemType(fs fsType) snapshots.Opt {
+	return func(info *snapshots.Info) error {
+		if info.Labels == nil {
+			info.Labels = make(map[string]string)
+		}
+
+		info.Labels[LabelFileSystemType] = string(fs)
+		return nil
+	}
+}
+
+// getFsType returns the file system type of a snapshot. Snapshots without the
+// file system type label fall back to the ZFS property of the dataset, and to
+// ext4 for volumes created before the file system type was recorded.
+func (s *snapshotter) getFsType(ctx context.Context, labels map[string]string, datasetName string) (fsType, error) {
+	if v, ok := labels[LabelFileSystemType]; ok {
+		return parseFsType(v)
+	}
+
+	v, err := s.volumes.GetProperty(ctx, datasetName, zfsFsTypeProperty)
+	if err != nil {
+		return "", err
+	}
+	if v == "" {
+		return fsTypeExt4, nil
+	}
+
+	return parseFsType(v)
+}
+
 func getLabelOpts(opts ...snapshots.Opt) map[string]string {
 	info := &snapshots.Info{
 		Labels: make(map[string]string),
@@ -620,22 +1388,23 @@ func getLabelOpts(opts ...snapshots.Opt) map[string]string {
 	return info.Labels
 }
 
-func setZfsLabelProperties(ctx context.Context, dataset *zfs.Dataset, labels map[string]string) error {
+// getZfsLabelProperties returns the zfs user properties propagating the
+// labels to the dataset.
+func getZfsLabelProperties(ctx context.Context, labels map[string]string) map[string]string {
+	props := make(map[string]string, len(labels))
 	for key, value := range labels {
 		propertyName := zfsLabelPropertyPrefix + sanitizeZfsLabelPropertyName(key)
 		if propertyName == zfsLabelPropertyPrefix {
-			log.G(ctx).Warnf("skipping empty label name for dataset %s", dataset.Name)
+			log.G(ctx).Warn("skipping empty label name")
 			continue
 		}
 		if len(propertyName) > zfsLabelPropertyMaxLength {
 			propertyName = propertyName[:zfsLabelPropertyMaxLength]
 			log.G(ctx).Warnf("truncated zfs label property name to %q", propertyName)
 		}
-		if err := dataset.SetProperty(propertyName, value); err != nil {
-			return err
-		}
+		props[propertyName] = value
 	}
-	return nil
+	return props
 }
 
 
@@ -0,0 +1,914 @@
+package zvol
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+	bolt "go.etcd.io/bbolt"
+)
+
+const testDataset = "tank/containerd"
+
+func newTestSnapshotter(t *testing.T, config *Config) (*snapshotter, *fakeVolumeManager) {
+	t.Helper()
+
+	config.RootPath = t.TempDir()
+	config.Dataset = testDataset
+	if config.VolumeSize == "" {
+		config.VolumeSize = "1GiB"
+	}
+
+	volumes := newFakeVolumeManager(t, "tank", testDataset)
+	s, err := newSnapshotter(context.Background(), config, volumes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+	})
+
+	return s, volumes
+}
+
+func TestSnapshotterLifecycle(t *testing.T) {
+	ctx := context.Background()
+	s, volumes := newTestSnapshotter(t, &Config{})
+
+	checkMounts := func(t *testing.T, mounts []mount.Mount, id string, fs fsType, readonly bool) {
+		t.Helper()
+		want := []mount.Mount{
+			{
+				Type:    string(fs),
+				Source:  volumes.DevicePath(testDataset + "/" + id),
+				Options: mountOptions(fs, readonly),
+			},
+		}
+		if len(mounts) != 1 || mounts[0].Type != want[0].Type || mounts[0].Source != want[0].Source || !slices.Equal(mounts[0].Options, want[0].Options) {
+			t.Errorf("want mounts %v, got %v", want, mounts)
+		}
+	}
+
+	checkDatasets := func(t *testing.T, want ...string) {
+		t.Helper()
+		want = append([]string{"tank", testDataset}, want...)
+		slices.Sort(want)
+		if got := volumes.names(); !slices.Equal(got, want) {
+			t.Errorf("want datasets %v, got %v", want, got)
+		}
+	}
+
+	t.Run("prepare base", func(t *testing.T) {
+		mounts, err := s.Prepare(ctx, "base-active", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMounts(t, mounts, "1", fsTypeExt4, false)
+		checkDatasets(t, testDataset+"/1")
+
+		if fs := volumes.fs[volumes.DevicePath(testDataset+"/1")]; fs != fsTypeExt4 {
+			t.Errorf("want file system %q, got %q", fsTypeExt4, fs)
+		}
+
+		if v, _ := volumes.GetProperty(ctx, testDataset+"/1", zfsMetadataKeyProperty); v != "base-active" {
+			t.Errorf("want metadata key %q, got %q", "base-active", v)
+		}
+		if n := volumes.updates[testDataset+"/1"]; n != 0 {
+			t.Errorf("want properties set at creation, got %d updates", n)
+		}
+
+		mounts, err = s.Mounts(ctx, "base-active")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMounts(t, mounts, "1", fsTypeExt4, false)
+	})
+
+	t.Run("commit base", func(t *testing.T) {
+		if err := s.Commit(ctx, "base", "base-active"); err != nil {
+			t.Fatal(err)
+		}
+		checkDatasets(t, testDataset+"/1", testDataset+"/1@snapshot")
+
+		if v, _ := volumes.GetProperty(ctx, testDataset+"/1", "volmode"); v != "none" {
+			t.Errorf("want volmode none, got %q", v)
+		}
+		if n := volumes.updates[testDataset+"/1"]; n != 2 {
+			t.Errorf("want 2 property updates, got %d", n)
+		}
+
+		info, err := s.Stat(ctx, "base")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Kind != snapshots.KindCommitted {
+			t.Errorf("want kind %v, got %v", snapshots.KindCommitted, info.Kind)
+		}
+		if info.Labels[LabelVolumeSize] != "1073741824" {
+			t.Errorf("want volume size label %q, got %q", "1073741824", info.Labels[LabelVolumeSize])
+		}
+
+		if _, err := s.Stat(ctx, "base-active"); err == nil {
+			t.Error("expected active snapshot to be removed after commit")
+		}
+	})
+
+	t.Run("prepare resized child", func(t *testing.T) {
+		mounts, err := s.Prepare(ctx, "child", "base", snapshots.WithLabels(map[string]string{
+			LabelVolumeSize: "2147483648",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMounts(t, mounts, "2", fsTypeExt4, false)
+
+		child, err := volumes.Get(ctx, testDataset+"/2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if child.Volsize != 2147483648 {
+			t.Errorf("want volume size %d, got %d", 2147483648, child.Volsize)
+		}
+		if !volumes.resized[volumes.DevicePath(child.Name)] {
+			t.Error("expected file system to be resized")
+		}
+		if v, _ := volumes.GetProperty(ctx, child.Name, zfsFsTypeProperty); v != string(fsTypeExt4) {
+			t.Errorf("want file system property %q, got %q", fsTypeExt4, v)
+		}
+		if v, _ := volumes.GetProperty(ctx, child.Name, zfsLabelPropertyPrefix+"containerd.io_snapshot_zvol_size"); v != "2147483648" {
+			t.Errorf("want size label property %q, got %q", "2147483648", v)
+		}
+		if v, _ := volumes.GetProperty(ctx, child.Name, zfsMetadataParentProperty); v != "base" {
+			t.Errorf("want metadata parent %q, got %q", "base", v)
+		}
+	})
+
+	t.Run("view", func(t *testing.T) {
+		mounts, err := s.View(ctx, "view", "base")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMounts(t, mounts, "3", fsTypeExt4, true)
+
+		if err := s.Commit(ctx, "view-committed", "view"); err == nil {
+			t.Error("expected commit of view to fail")
+		}
+	})
+
+	t.Run("remove parent with children", func(t *testing.T) {
+		if err := s.Remove(ctx, "base"); err == nil {
+			t.Fatal("expected remove of parent to fail")
+		}
+		if _, err := s.Stat(ctx, "base"); err != nil {
+			t.Errorf("expected parent metadata to be kept: %v", err)
+		}
+		if d := volumes.datasets[testDataset+"/1@snapshot"]; d == nil || d.deferred {
+			t.Error("expected parent zfs snapshot to be kept")
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		for _, key := range []string{"child", "view", "base"} {
+			if err := s.Remove(ctx, key); err != nil {
+				t.Fatalf("failed to remove %s: %v", key, err)
+			}
+		}
+		checkDatasets(t)
+
+		var keys []string
+		if err := s.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+			keys = append(keys, info.Name)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 0 {
+			t.Errorf("want no snapshots, got %v", keys)
+		}
+	})
+}
+
+func TestSnapshotterFileSystemType(t *testing.T) {
+	ctx := context.Background()
+	s, volumes := newTestSnapshotter(t, &Config{})
+
+	mounts, err := s.Prepare(ctx, "xfs", "", snapshots.WithLabels(map[string]string{
+		LabelFileSystemType: string(fsTypeXfs),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mounts[0].Type != string(fsTypeXfs) || !slices.Contains(mounts[0].Options, "nouuid") {
+		t.Errorf("want xfs mount with nouuid option, got %v", mounts[0])
+	}
+	if fs := volumes.fs[mounts[0].Source]; fs != fsTypeXfs {
+		t.Errorf("want file system %q, got %q", fsTypeXfs, fs)
+	}
+	if err := s.Commit(ctx, "xfs-base", "xfs"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		parent string
+		label  string
+		want   fsType
+		// invalid reports whether the label is rejected
+		invalid bool
+	}{
+		{
+			name: "default",
+			want: fsTypeExt4,
+		},
+		{
+			name:  "label",
+			label: string(fsTypeXfs),
+			want:  fsTypeXfs,
+		},
+		{
+			name:    "unsupported label",
+			label:   "btrfs",
+			invalid: true,
+		},
+		{
+			name:   "parent",
+			parent: "xfs-base",
+			want:   fsTypeXfs,
+		},
+		{
+			name:   "parent with matching label",
+			parent: "xfs-base",
+			label:  string(fsTypeXfs),
+			want:   fsTypeXfs,
+		},
+		{
+			name:    "parent with conflicting label",
+			parent:  "xfs-base",
+			label:   string(fsTypeExt4),
+			invalid: true,
+		},
+		{
+			name:    "parent with unsupported label",
+			parent:  "xfs-base",
+			label:   "btrfs",
+			invalid: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var opts []snapshots.Opt
+			if tc.label != "" {
+				opts = append(opts, snapshots.WithLabels(map[string]string{
+					LabelFileSystemType: tc.label,
+				}))
+			}
+
+			mounts, err := s.Prepare(ctx, tc.name, tc.parent, opts...)
+			if tc.invalid {
+				if !errdefs.IsInvalidArgument(err) {
+					t.Errorf("want invalid argument error, got %v", err)
+				}
+				if _, err := s.Stat(ctx, tc.name); err == nil {
+					t.Error("expected snapshot not to be created")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if mounts[0].Type != string(tc.want) {
+				t.Errorf("want mount type %q, got %q", tc.want, mounts[0].Type)
+			}
+			info, err := s.Stat(ctx, tc.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Labels[LabelFileSystemType] != string(tc.want) {
+				t.Errorf("want file system label %q, got %q", tc.want, info.Labels[LabelFileSystemType])
+			}
+		})
+	}
+}
+
+func TestSnapshotterCleanup(t *testing.T) {
+	ctx := context.Background()
+	s, volumes := newTestSnapshotter(t, &Config{})
+
+	if _, err := s.Prepare(ctx, "active", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := volumes.CreateVolume(ctx, testDataset+"/9", 1024, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := volumes.CreateVolume(ctx, testDataset+"/template", 1024, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"tank", testDataset, testDataset + "/1", testDataset + "/template"}
+	if got := volumes.names(); !slices.Equal(got, want) {
+		t.Errorf("want datasets %v, got %v", want, got)
+	}
+}
+
+func TestSnapshotterConcurrentPrepare(t *testing.T) {
+	ctx := context.Background()
+	s, volumes := newTestSnapshotter(t, &Config{})
+
+	// Both file systems are only created once both snapshots are being
+	// created, which deadlocks when creating a snapshot blocks the other.
+	var started sync.WaitGroup
+	started.Add(2)
+	volumes.mkfs = func(device string) error {
+		started.Done()
+		started.Wait()
+		return nil
+	}
+
+	errs := make(chan error, 2)
+	for _, key := range []string{"a", "b"} {
+		go func() {
+			_, err := s.Prepare(ctx, key, "")
+			errs <- err
+		}()
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := s.Mounts(ctx, "a"); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.Mounts(ctx, "b"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSnapshotterCloseWaitsForOperations(t *testing.T) {
+	ctx := context.Background()
+	s, volumes := newTestSnapshotter(t, &Config{})
+
+	mkfs := make(chan struct{})
+	release := make(chan struct{})
+	volumes.mkfs = func(device string) error {
+		close(mkfs)
+		<-release
+		return nil
+	}
+
+	prepared := make(chan error, 1)
+	go func() {
+		_, err := s.Prepare(ctx, "active", "")
+		prepared <- err
+	}()
+	<-mkfs
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- s.Close()
+	}()
+
+	select {
+	case err := <-closed:
+		t.Fatalf("want close to wait for prepare, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-prepared; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Prepare(ctx, "new", ""); !errdefs.IsUnavailable(err) {
+		t.Errorf("want unavailable error after close, got %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("want nil closing again, got %v", err)
+	}
+}
+
+func TestSnapshotterUpdate(t *testing.T) {
+	ctx := context.Background()
+	s, volumes := newTestSnapshotter(t, &Config{})
+
+	if _, err := s.Prepare(ctx, "active", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("labels", func(t *testing.T) {
+		info, err := s.Update(ctx, snapshots.Info{
+			Name:   "active",
+			Labels: map[string]string{"example.com/owner": "ci"},
+		}, "labels.example.com/owner")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Labels[LabelFileSystemType] != string(fsTypeExt4) {
+			t.Errorf("want file system label %q, got %q", fsTypeExt4, info.Labels[LabelFileSystemType])
+		}
+		if v, _ := volumes.GetProperty(ctx, testDataset+"/1", zfsMetadataLabelsProperty); !strings.Contains(v, `"example.com/owner":"ci"`) {
+			t.Errorf("want labels property with %q, got %q", "example.com/owner", v)
+		}
+	})
+
+	t.Run("file system type", func(t *testing.T) {
+		for _, tc := range []struct {
+			name       string
+			labels     map[string]string
+			fieldpaths []string
+		}{
+			{
+				name:       "changed",
+				labels:     map[string]string{LabelFileSystemType: string(fsTypeXfs)},
+				fieldpaths: []string{"labels." + LabelFileSystemType},
+			},
+			{
+				name:       "removed",
+				labels:     map[string]string{},
+				fieldpaths: []string{"labels"},
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				_, err := s.Update(ctx, snapshots.Info{Name: "active", Labels: tc.labels}, tc.fieldpaths...)
+				if !errdefs.IsInvalidArgument(err) {
+					t.Fatalf("want invalid argument error, got %v", err)
+				}
+
+				info, err := s.Stat(ctx, "active")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Labels[LabelFileSystemType] != string(fsTypeExt4) {
+					t.Errorf("want file system label %q, got %q", fsTypeExt4, info.Labels[LabelFileSystemType])
+				}
+			})
+		}
+	})
+}
+
+func TestSnapshotterBlockDeviceMounts(t *testing.T) {
+	// The fake volumes are regular files, point the volume at a block device
+	// of the host instead.
+	devices, _ := filepath.Glob("/dev/*")
+	i := slices.IndexFunc(devices, func(path string) bool {
+		fi, err := os.Stat(path)
+		return err == nil && fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0
+	})
+	if i < 0 {
+		t.Skip("no block device found")
+	}
+	device := devices[i]
+
+	ctx := context.Background()
+	s, volumes := newTestSnapshotter(t, &Config{})
+
+	mounts, err := s.Prepare(ctx, "active", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(mounts[0].Options, MountOptionBlockDevice) {
+		t.Errorf("want file system mount without %q, got options %v", MountOptionBlockDevice, mounts[0].Options)
+	}
+
+	name := testDataset + "/1"
+	if err := os.Remove(volumes.DevicePath(name)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(device, volumes.DevicePath(name)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Update(ctx, snapshots.Info{
+		Name:   "active",
+		Labels: map[string]string{LabelBlockDevice: "true"},
+	}, "labels."+LabelBlockDevice); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts, err = s.Mounts(ctx, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 1 {
+		t.Fatalf("want 1 mount, got %d", len(mounts))
+	}
+	if mounts[0].Source != device {
+		t.Errorf("want source %q, got %q", device, mounts[0].Source)
+	}
+	if mounts[0].Type != string(fsTypeExt4) {
+		t.Errorf("want type %q, got %q", fsTypeExt4, mounts[0].Type)
+	}
+	if !slices.Contains(mounts[0].Options, MountOptionBlockDevice) {
+		t.Errorf("want option %q, got %v", MountOptionBlockDevice, mounts[0].Options)
+	}
+}
+
+func TestSnapshotterPrepareResize(t *testing.T) {
+	ctx := context.Background()
+	errResize := errors.New("resize failed")
+
+	for _, tc := range []struct {
+		name          string
+		setProperties func(name string, properties map[string]string) error
+		resizefs      func(device string) error
+		err           error
+	}{
+		{
+			name: "grow",
+		},
+		{
+			name: "volume size fails",
+			setProperties: func(name string, properties map[string]string) error {
+				if _, ok := properties["volsize"]; ok {
+					return errResize
+				}
+				return nil
+			},
+			err: errResize,
+		},
+		{
+			name: "file system fails",
+			resizefs: func(device string) error {
+				return errResize
+			},
+			err: errResize,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, volumes := newTestSnapshotter(t, &Config{})
+
+			if _, err := s.Prepare(ctx, "base-active", ""); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Commit(ctx, "base", "base-active"); err != nil {
+				t.Fatal(err)
+			}
+			committed := volumes.names()
+
+			volumes.setProperties = tc.setProperties
+			volumes.resizefs = tc.resizefs
+
+			_, err := s.Prepare(ctx, "child", "base", snapshots.WithLabels(map[string]string{
+				LabelVolumeSize: "2147483648",
+			}))
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("want %v, got %v", tc.err, err)
+			}
+
+			if tc.err == nil {
+				child, err := volumes.Get(ctx, testDataset+"/2")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if child.Volsize != 2147483648 {
+					t.Errorf("want volume size %d, got %d", 2147483648, child.Volsize)
+				}
+				if !volumes.resized[volumes.DevicePath(child.Name)] {
+					t.Error("expected file system to be resized")
+				}
+				return
+			}
+
+			// The clone is destroyed with the metadata of the snapshot.
+			if _, err := s.Stat(ctx, "child"); err == nil {
+				t.Error("expected snapshot metadata to be removed")
+			}
+			if got := volumes.names(); !slices.Equal(got, committed) {
+				t.Errorf("want datasets %v, got %v", committed, got)
+			}
+		})
+	}
+}
+
+func TestSnapshotterPrepareRollback(t *testing.T) {
+	ctx := context.Background()
+	s, volumes := newTestSnapshotter(t, &Config{})
+
+	errMkfs := errors.New("mkfs failed")
+	volumes.mkfs = func(device string) error {
+		return errMkfs
+	}
+
+	if _, err := s.Prepare(ctx, "active", ""); !errors.Is(err, errMkfs) {
+		t.Fatalf("want %v, got %v", errMkfs, err)
+	}
+	if _, err := s.Stat(ctx, "active"); err == nil {
+		t.Error("expected snapshot metadata to be removed")
+	}
+	want := []string{"tank", testDataset}
+	if got := volumes.names(); !slices.Equal(got, want) {
+		t.Errorf("want datasets %v, got %v", want, got)
+	}
+
+	volumes.mkfs = nil
+	if _, err := s.Prepare(ctx, "active", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotterCommitRollback(t *testing.T) {
+	ctx := context.Background()
+	s, volumes := newTestSnapshotter(t, &Config{})
+
+	if _, err := s.Prepare(ctx, "active", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	errHide := errors.New("set volmode failed")
+	volumes.setProperties = func(name string, properties map[string]string) error {
+		if _, ok := properties["volmode"]; ok {
+			return errHide
+		}
+		return nil
+	}
+
+	if err := s.Commit(ctx, "committed", "active"); !errors.Is(err, errHide) {
+		t.Fatalf("want %v, got %v", errHide, err)
+	}
+	if info, err := s.Stat(ctx, "active"); err != nil || info.Kind != snapshots.KindActive {
+		t.Errorf("want active snapshot to be kept, got %+v, %v", info, err)
+	}
+	for _, name := range volumes.names() {
+		if strings.Contains(name, "@") {
+			t.Errorf("want snapshot of failed commit to be destroyed, got %s", name)
+		}
+	}
+
+	volumes.setProperties = nil
+	if err := s.Commit(ctx, "committed", "active"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotterCommitInterrupted(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{name: "same key", key: "committed"},
+		{name: "other key", key: "other", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, volumes := newTestSnapshotter(t, &Config{})
+
+			if _, err := s.Prepare(ctx, "active", ""); err != nil {
+				t.Fatal(err)
+			}
+
+			// A crash after the zfs snapshot was taken and before the volume
+			// was hidden leaves the snapshot with the properties of the commit.
+			name := testDataset + "/1"
+			props, err := getZfsMetadataProperties(ctx, snapshots.Info{Kind: snapshots.KindCommitted, Name: tc.key})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := volumes.SetProperties(ctx, name, props); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := volumes.Snapshot(ctx, name, snapshotSuffix); err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.Commit(ctx, "committed", "active")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				if info, err := s.Stat(ctx, "active"); err != nil || info.Kind != snapshots.KindActive {
+					t.Errorf("want active snapshot to be kept, got %+v, %v", info, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info, err := s.Stat(ctx, "committed"); err != nil || info.Kind != snapshots.KindCommitted {
+				t.Errorf("want committed snapshot, got %+v, %v", info, err)
+			}
+			if volmode, _ := volumes.GetProperty(ctx, name, "volmode"); volmode != "none" {
+				t.Errorf("want volmode none, got %q", volmode)
+			}
+		})
+	}
+}
+
+func TestSnapshotterCommitOutsideTransaction(t *testing.T) {
+	ctx := context.Background()
+	s, volumes := newTestSnapshotter(t, &Config{})
+
+	if _, err := s.Prepare(ctx, "active", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	reached := make(chan struct{})
+	release := make(chan struct{})
+	volumes.setProperties = func(name string, properties map[string]string) error {
+		if _, ok := properties[zfsMetadataKeyProperty]; ok {
+			close(reached)
+			<-release
+		}
+		return nil
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Commit(ctx, "committed", "active")
+	}()
+	<-reached
+
+	// Metadata can be written while the volume of the snapshot is committed.
+	written := make(chan error, 1)
+	go func() {
+		written <- s.store.WithTransaction(ctx, true, func(ctx context.Context) error {
+			return nil
+		})
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("want write transaction while committing the volume, got blocked")
+	}
+
+	close(release)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := s.Stat(ctx, "committed"); err != nil || info.Kind != snapshots.KindCommitted {
+		t.Errorf("want committed snapshot, got %+v, %v", info, err)
+	}
+}
+
+func TestSnapshotterUpdateOutsideTransaction(t *testing.T) {
+	ctx := context.Background()
+	s, volumes := newTestSnapshotter(t, &Config{})
+
+	if _, err := s.Prepare(ctx, "active", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	reached := make(chan struct{})
+	release := make(chan struct{})
+	volumes.setProperties = func(name string, properties map[string]string) error {
+		if _, ok := properties[zfsMetadataLabelsProperty]; ok {
+			close(reached)
+			<-release
+		}
+		return nil
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.Update(ctx, snapshots.Info{
+			Name:   "active",
+			Labels: map[string]string{"example.com/owner": "ci"},
+		}, "labels.example.com/owner")
+		errs <- err
+	}()
+	<-reached
+
+	// Metadata can be written while the properties of the volume are set.
+	written := make(chan error, 1)
+	go func() {
+		written <- s.store.WithTransaction(ctx, true, func(ctx context.Context) error {
+			return nil
+		})
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("want write transaction while updating the volume, got blocked")
+	}
+
+	close(release)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := s.Stat(ctx, "active"); err != nil || info.Labels["example.com/owner"] != "ci" {
+		t.Errorf("want updated labels, got %+v, %v", info, err)
+	}
+}
+
+func TestSnapshotterUsageWaitsForPrepare(t *testing.T) {
+	ctx := context.Background()
+	s, volumes := newTestSnapshotter(t, &Config{})
+
+	reached := make(chan struct{})
+	release := make(chan struct{})
+	volumes.mkfs = func(device string) error {
+		close(reached)
+		<-release
+		return nil
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.Prepare(ctx, "active", "")
+		errs <- err
+	}()
+	<-reached
+
+	usage := make(chan error, 1)
+	go func() {
+		_, err := s.Usage(ctx, "active")
+		usage <- err
+	}()
+	select {
+	case err := <-usage:
+		t.Fatalf("want usage to wait for the snapshot being created, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-usage; err != nil {
+		t.Errorf("want usage of created snapshot, got %v", err)
+	}
+}
+
+func TestSnapshotterRemovesUnfinishedSnapshots(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		reserved bool
+		kept     bool
+	}{
+		// A crash between reserving the metadata and creating the volume
+		// leaves a reserved snapshot without a volume.
+		{name: "unfinished", reserved: true},
+		// A volume destroyed outside of the snapshotter is only reported.
+		{name: "destroyed", kept: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, volumes := newTestSnapshotter(t, &Config{})
+
+			if _, err := s.Prepare(ctx, "active", ""); err != nil {
+				t.Fatal(err)
+			}
+			if tc.reserved {
+				if err := withBoltTransaction(ctx, s.store, true, func(ctx context.Context, tx *bolt.Tx) error {
+					return markReserved(tx, "1")
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := volumes.Destroy(ctx, testDataset+"/1", destroyDefault); err != nil {
+				t.Fatal(err)
+			}
+
+			config := *s.config
+			s, err := newSnapshotter(ctx, &config, volumes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			_, err = s.Stat(ctx, "active")
+			if tc.kept {
+				if err != nil {
+					t.Errorf("want dangling snapshot to be kept, got %v", err)
+				}
+				return
+			}
+			if !errdefs.IsNotFound(err) {
+				t.Errorf("want unfinished snapshot to be removed, got %v", err)
+			}
+			if _, err := s.Prepare(ctx, "active", ""); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package zvol
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containerd/log"
+)
+
+// Template volumes are named <dataset>/template-<fs>-<size>-<fingerprint>.
+// The names are not snapshot IDs, so templates are ignored by reconcile and
+// cleanup and can't be removed through the snapshotter.
+const templatePrefix = "template-"
+
+// templates manages formatted empty template volumes. Snapshots without a
+// parent are cloned from the snapshot of the template matching their volume
+// size and file system type instead of creating a file system for each of
+// them.
+type templates struct {
+	volumes volumeManager
+	dataset string
+	// properties are the properties of the template volumes.
+	properties map[string]string
+	// format creates the file system on a volume.
+	format func(ctx context.Context, name string, fs fsType) error
+	// destroy destroys a template that is no longer used.
+	destroy func(ctx context.Context, state *zvolState) error
+
+	// locks serializes creating the same template.
+	locks keyLocks
+
+	mu sync.Mutex
+	// ready records the template snapshots known to exist.
+	ready map[string]bool
+}
+
+func newTemplates(s *snapshotter, config *Config) *templates {
+	return &templates{
+		volumes:    s.volumes,
+		dataset:    s.dataset.Name,
+		properties: createVolumeProperties(config.VolumeProperties),
+		format:     s.formatVolume,
+		destroy:    s.destroyOrphan,
+		ready:      make(map[string]bool),
+	}
+}
+
+// name returns the name of the template volume for the volume size and file
+// system type. The fingerprint changes with the volume properties and mkfs
+// options, so templates are recreated when they change.
+func (t *templates) name(size uint64, fs fsType) string {
+	return path.Join(t.dataset, fmt.Sprintf("%s%s-%d-%s", templatePrefix, fs, size, volumeFingerprint(size, fs, t.properties)))
+}
+
+// current reports whether a template volume name matches the current
+// volume properties and mkfs options.
+func (t *templates) current(name string) bool {
+	rest, ok := strings.CutPrefix(path.Base(name), templatePrefix)
+	if !ok {
+		return false
+	}
+	parts := strings.Split(rest, "-")
+	if len(parts) != 3 {
+		return false
+	}
+	fs, err := parseFsType(parts[0])
+	if err != nil {
+		return false
+	}
+	size, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return false
+	}
+	return t.name(size, fs) == name
+}
+
+// get returns the snapshot of the template for the volume size and file
+// system type, creating the template when it doesn't exist.
+func (t *templates) get(ctx context.Context, size uint64, fs fsType) (string, error) {
+	name := t.name(size, fs)
+	snapshot := name + "@" + snapshotSuffix
+
+	t.locks.lock(name)
+	defer t.locks.unlock(name)
+
+	t.mu.Lock()
+	ready := t.ready[snapshot]
+	t.mu.Unlock()
+	if ready {
+		return snapshot, nil
+	}
+
+	if _, err := t.volumes.Get(ctx, snapshot); err != nil {
+		if err := t.create(ctx, name, size, fs); err != nil {
+			return "", fmt.Errorf("failed to create template %s: %w", name, err)
+		}
+	}
+
+	t.mu.Lock()
+	t.ready[snapshot] = true
+	t.mu.Unlock()
+
+	return snapshot, nil
+}
+
+// forget drops a template snapshot that could not be cloned, so it is
+// checked again the next time it is used.
+func (t *templates) forget(snapshot string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.ready, snapshot)
+}
+
+// create creates and formats a template volume and snapshots it. A template
+// volume without snapshot was not completely created and is replaced.
+func (t *templates) create(ctx context.Context, name string, size uint64, fs fsType) error {
+	if _, err := t.volumes.Get(ctx, name); err == nil {
+		if err := t.volumes.Destroy(ctx, name, destroyDefault); err != nil {
+			return err
+		}
+	}
+
+	log.G(ctx).Infof("creating template %s", name)
+	if _, err := t.volumes.CreateVolume(ctx, name, size, t.properties); err != nil {
+		return err
+	}
+
+	if err := t.format(ctx, name, fs); err != nil {
+		return err
+	}
+
+	// The template volume is hidden like the volume of a committed snapshot.
+	_, err := t.volumes.Commit(ctx, name, snapshotSuffix, nil)
+	return err
+}
+
+// cleanup destroys the templates of previous volume properties or mkfs
+// options. A template snapshot that still has clones is marked for deferred
+// destruction and its volume is destroyed by a later cleanup.
+func (t *templates) cleanup(ctx context.Context) error {
+	children, err := t.volumes.Children(ctx, t.dataset, 2)
+	if err != nil {
+		return err
+	}
+
+	stale := make(map[string]*zvolState)
+	for _, child := range children {
+		name, snapshot, _ := strings.Cut(child.Name, "@")
+		if !strings.HasPrefix(path.Base(name), templatePrefix) || t.current(name) {
+			continue
+		}
+
+		state, ok := stale[name]
+		if !ok {
+			state = &zvolState{}
+			stale[name] = state
+		}
+		switch snapshot {
+		case "":
+			state.volume = child
+		case snapshotSuffix:
+			state.snapshot = child
+		}
+	}
+
+	for name, state := range stale {
+		log.G(ctx).Infof("destroying outdated template %s", name)
+		if err := t.destroy(ctx, state); err != nil {
+			return err
+		}
+		t.forget(name + "@" + snapshotSuffix)
+	}
+
+	return nil
+}
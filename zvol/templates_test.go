@@ -0,0 +1,125 @@
+package zvol
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+)
+
+func TestSnapshotterBaseTemplate(t *testing.T) {
+	ctx := context.Background()
+
+	var formatted atomic.Int32
+	config := &Config{BaseTemplate: true}
+	config.RootPath = t.TempDir()
+	config.Dataset = testDataset
+	config.VolumeSize = "1GiB"
+	volumes := newFakeVolumeManager(t, "tank", testDataset)
+	volumes.mkfs = func(device string) error {
+		formatted.Add(1)
+		return nil
+	}
+	s, err := newSnapshotter(ctx, config, volumes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ext4Template := s.templates.name(1073741824, fsTypeExt4)
+	xfsTemplate := s.templates.name(1073741824, fsTypeXfs)
+
+	t.Run("startup", func(t *testing.T) {
+		if !strings.HasPrefix(ext4Template, testDataset+"/template-ext4-1073741824-") {
+			t.Errorf("unexpected template name %s", ext4Template)
+		}
+		if _, err := volumes.Get(ctx, ext4Template+"@"+snapshotSuffix); err != nil {
+			t.Errorf("expected template snapshot: %s", err)
+		}
+		if v, _ := volumes.GetProperty(ctx, ext4Template, "volmode"); v != "none" {
+			t.Errorf("want volmode none, got %q", v)
+		}
+		if n := formatted.Load(); n != 1 {
+			t.Errorf("want 1 file system created, got %d", n)
+		}
+	})
+
+	t.Run("clone", func(t *testing.T) {
+		if _, err := s.Prepare(ctx, "base", ""); err != nil {
+			t.Fatal(err)
+		}
+		if origin := volumes.datasets[testDataset+"/1"].origin; origin != ext4Template+"@"+snapshotSuffix {
+			t.Errorf("want origin %s, got %q", ext4Template+"@"+snapshotSuffix, origin)
+		}
+		if v, _ := volumes.GetProperty(ctx, testDataset+"/1", zfsMetadataKeyProperty); v != "base" {
+			t.Errorf("want metadata key %q, got %q", "base", v)
+		}
+		if n := formatted.Load(); n != 1 {
+			t.Errorf("want 1 file system created, got %d", n)
+		}
+	})
+
+	t.Run("other file system", func(t *testing.T) {
+		if _, err := s.Prepare(ctx, "xfs", "", snapshots.WithLabels(map[string]string{
+			LabelFileSystemType: string(fsTypeXfs),
+		})); err != nil {
+			t.Fatal(err)
+		}
+		if origin := volumes.datasets[testDataset+"/2"].origin; origin != xfsTemplate+"@"+snapshotSuffix {
+			t.Errorf("want origin %s, got %q", xfsTemplate+"@"+snapshotSuffix, origin)
+		}
+		if n := formatted.Load(); n != 2 {
+			t.Errorf("want 2 file systems created, got %d", n)
+		}
+	})
+
+	t.Run("cleanup keeps templates", func(t *testing.T) {
+		if err := s.Cleanup(ctx); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{ext4Template, xfsTemplate} {
+			if _, err := volumes.Get(ctx, name+"@"+snapshotSuffix); err != nil {
+				t.Errorf("expected template snapshot: %s", err)
+			}
+		}
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		if err := s.Remove(ctx, "xfs"); err != nil {
+			t.Fatal(err)
+		}
+
+		s.config.VolumeProperties = map[string]string{"compression": "zstd"}
+		s.templates = newTemplates(s, s.config)
+		if err := s.Cleanup(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		// The template of the ext4 snapshot is destroyed with its last clone.
+		if _, err := volumes.Get(ctx, xfsTemplate); err == nil {
+			t.Errorf("expected template %s to be destroyed", xfsTemplate)
+		}
+		if !volumes.datasets[ext4Template+"@"+snapshotSuffix].deferred {
+			t.Errorf("expected template snapshot %s to be marked for deferred destruction", ext4Template)
+		}
+
+		if err := s.Remove(ctx, "base"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Cleanup(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := volumes.Get(ctx, ext4Template); err == nil {
+			t.Errorf("expected template %s to be destroyed", ext4Template)
+		}
+
+		if _, err := s.Prepare(ctx, "upgraded", ""); err != nil {
+			t.Fatal(err)
+		}
+		if origin := volumes.datasets[testDataset+"/3"].origin; origin == "" || origin == ext4Template+"@"+snapshotSuffix {
+			t.Errorf("want clone of upgraded template, got origin %q", origin)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package zvol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/testsuite"
+)
+
+// newTestPool creates a zpool backed by a sparse file for the duration of the
+// test. The test is skipped when it can't run zfs commands.
+func newTestPool(t testing.TB) string {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test that requires root")
+	}
+	if _, err := os.Stat("/dev/zfs"); err != nil {
+		t.Skip("skipping test that requires the zfs kernel module")
+	}
+	for _, command := range []string{"zpool", "zfs"} {
+		if _, err := exec.LookPath(command); err != nil {
+			t.Skipf("skipping test that requires %s", command)
+		}
+	}
+
+	vdev := filepath.Join(t.TempDir(), "vdev")
+	f, err := os.Create(vdev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(16 * 1024 * 1024 * 1024)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := fmt.Sprintf("zvol-test-%d", os.Getpid())
+	if out, err := exec.Command("zpool", "create", "-O", "mountpoint=none", pool, vdev).CombinedOutput(); err != nil {
+		t.Fatalf("failed to create zpool: %s: %v", out, err)
+	}
+	t.Cleanup(func() {
+		if out, err := exec.Command("zpool", "destroy", "-f", pool).CombinedOutput(); err != nil {
+			t.Errorf("failed to destroy zpool: %s: %v", out, err)
+		}
+	})
+
+	return pool
+}
+
+func TestZvolSnapshotterSuite(t *testing.T) {
+	pool := newTestPool(t)
+
+	var n atomic.Uint64
+	for _, backend := range []backend{backendCLI, backendIoctl} {
+		t.Run(string(backend), func(t *testing.T) {
+			testsuite.SnapshotterSuite(t, "zvol", func(ctx context.Context, root string) (snapshots.Snapshotter, func() error, error) {
+				dataset := fmt.Sprintf("%s/suite-%d", pool, n.Add(1))
+				if out, err := exec.Command("zfs", "create", dataset).CombinedOutput(); err != nil {
+					return nil, nil, fmt.Errorf("failed to create dataset: %s: %w", out, err)
+				}
+
+				sn, err := NewSnapshotter(ctx, &Config{
+					RootPath:   root,
+					Dataset:    dataset,
+					VolumeSize: "256MiB",
+					Backend:    backend,
+				})
+				if err != nil {
+					return nil, nil, err
+				}
+
+				return sn, func() error {
+					errs := []error{sn.Close()}
+					if out, err := exec.Command("zfs", "destroy", "-r", dataset).CombinedOutput(); err != nil {
+						errs = append(errs, fmt.Errorf("failed to destroy dataset: %s: %w", out, err))
+					}
+					return errors.Join(errs...)
+				}, nil
+			})
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package zvol
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracingServiceName = "containerd-zvol-grpc"
+
+type tracingExporter string
+
+const (
+	// tracingExporterNone disables tracing.
+	tracingExporterNone tracingExporter = "none"
+	// tracingExporterOTLP exports spans to an OpenTelemetry collector.
+	tracingExporterOTLP tracingExporter = "otlp"
+)
+
+type otlpProtocol string
+
+const (
+	// otlpProtocolGRPC exports spans with OTLP over gRPC.
+	otlpProtocolGRPC otlpProtocol = "grpc"
+	// otlpProtocolHTTP exports spans with OTLP over HTTP with protobuf
+	// payloads.
+	otlpProtocolHTTP otlpProtocol = "http/protobuf"
+)
+
+// tracer traces snapshotter operations. It uses the global tracer provider,
+// so spans are dropped until SetupTracing installs an exporter.
+var tracer = otel.Tracer("github.com/welteki/zvol-snapshotter/zvol")
+
+// SetupTracing installs the global tracer provider and propagator for the
+// tracing config. The returned function flushes pending spans and stops the
+// exporter.
+func SetupTracing(ctx context.Context, config *TracingConfig) (func(context.Context) error, error) {
+	if config.Exporter == "" || config.Exporter == tracingExporterNone {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := newSpanExporter(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	// Attributes from OTEL_RESOURCE_ATTRIBUTES and OTEL_SERVICE_NAME take
+	// precedence over the defaults.
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(attribute.String("service.name", tracingServiceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	ratio := 1.0
+	if config.SamplingRatio != nil {
+		ratio = *config.SamplingRatio
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
+
+func newSpanExporter(ctx context.Context, config *TracingConfig) (sdktrace.SpanExporter, error) {
+	switch config.Exporter {
+	case tracingExporterOTLP:
+	default:
+		return nil, fmt.Errorf("unsupported tracing exporter: %q", config.Exporter)
+	}
+
+	switch config.Protocol {
+	case otlpProtocolGRPC, "":
+		var opts []otlptracegrpc.Option
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case otlpProtocolHTTP:
+		var opts []otlptracehttp.Option
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol: %q", config.Protocol)
+	}
+}
+
+// startSpan starts a span as child of the span in ctx.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the error of the traced operation and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// withTempMount is mount.WithTempMount in a span, to tell the time spent
+// mounting and unmounting from the time spent on the operation itself.
+func withTempMount(ctx context.Context, mounts []mount.Mount, f func(root string) error) (err error) {
+	ctx, span := startSpan(ctx, "mount.temp")
+	if len(mounts) > 0 {
+		span.SetAttributes(
+			attribute.String("mount.type", mounts[0].Type),
+			attribute.String("mount.source", mounts[0].Source),
+		)
+	}
+	defer func() {
+		endSpan(span, err)
+	}()
+	return mount.WithTempMount(ctx, mounts, f)
+}
@@ -0,0 +1,85 @@
+package zvol
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSnapshotterTracing(t *testing.T) {
+	ctx := context.Background()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		provider.Shutdown(ctx)
+	})
+
+	config := &Config{
+		RootPath:   t.TempDir(),
+		Dataset:    testDataset,
+		VolumeSize: "1GiB",
+	}
+	volumes := newFakeVolumeManager(t, "tank", testDataset)
+	s, err := newSnapshotter(ctx, config, &instrumentedVolumeManager{volumeManager: volumes, backend: backendCLI})
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := &instrumentedSnapshotter{snapshotter: s}
+	t.Cleanup(func() {
+		is.Close()
+	})
+
+	if _, err := is.Prepare(ctx, "active", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	prepare, ok := spans["snapshotter.prepare"]
+	if !ok {
+		t.Fatalf("want snapshotter.prepare span, got %v", spanNames(recorder.Ended()))
+	}
+
+	for _, name := range []string{"metadata.reserve", "zfs.create_volume", "mkfs"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("want %s span, got %v", name, spanNames(recorder.Ended()))
+			continue
+		}
+		if span.Parent().SpanID() != prepare.SpanContext().SpanID() {
+			t.Errorf("want %s span to be a child of snapshotter.prepare", name)
+		}
+	}
+
+	t.Run("error", func(t *testing.T) {
+		if _, err := is.Prepare(ctx, "active", ""); err == nil {
+			t.Fatal("want error preparing existing snapshot, got nil")
+		}
+
+		ended := recorder.Ended()
+		span := ended[len(ended)-1]
+		if span.Name() != "snapshotter.prepare" {
+			t.Fatalf("want last span snapshotter.prepare, got %s", span.Name())
+		}
+		if span.Status().Code != codes.Error {
+			t.Errorf("want error status, got %s", span.Status().Code)
+		}
+	})
+}
+
+func spanNames(spans []sdktrace.ReadOnlySpan) []string {
+	names := make([]string, 0, len(spans))
+	for _, span := range spans {
+		names = append(names, span.Name())
+	}
+	return names
+}
@@ -0,0 +1,121 @@
+package zvol
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/core/mount"
+)
+
+// Types of zfs datasets.
+const (
+	datasetFilesystem = "filesystem"
+	datasetVolume     = "volume"
+	datasetSnapshot   = "snapshot"
+)
+
+// dataset describes a zfs dataset.
+type dataset struct {
+	Name    string
+	Type    string
+	Used    uint64
+	Avail   uint64
+	Volsize uint64
+}
+
+// destroyFlag controls how a dataset is destroyed.
+type destroyFlag int
+
+const (
+	destroyDefault destroyFlag = 1 << iota
+	// destroyRecursive also destroys the snapshots of a volume.
+	destroyRecursive
+	// destroyDeferDeletion marks a snapshot that still has clones for
+	// destruction once the last clone is destroyed.
+	destroyDeferDeletion
+)
+
+type backend string
+
+const (
+	// backendCLI manages datasets with the zfs command line tools.
+	backendCLI backend = "cli"
+	// backendIoctl manages datasets through the zfs ioctl interface.
+	backendIoctl backend = "ioctl"
+)
+
+// newVolumeManager returns the volume manager for the configured backend.
+func newVolumeManager(config *Config) (volumeManager, error) {
+	switch config.Backend {
+	case backendIoctl:
+		return newIoctlVolumeManager()
+	case backendCLI, "":
+		return &zfsVolumeManager{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported backend: %q", config.Backend)
+	}
+}
+
+// volumeManager manages the zfs datasets and file systems backing snapshots.
+// Dataset names are full zfs dataset names including the pool.
+type volumeManager interface {
+	// Get returns the dataset with the given name.
+	Get(ctx context.Context, name string) (*dataset, error)
+
+	// Children returns the descendants of a dataset up to the given depth.
+	// Snapshots of a volume are one level below the volume.
+	Children(ctx context.Context, name string, depth uint64) ([]*dataset, error)
+
+	// CreateVolume creates a volume of the given size.
+	CreateVolume(ctx context.Context, name string, size uint64, properties map[string]string) (*dataset, error)
+
+	// CheckVolumeProperties validates the properties for volumes created
+	// under the parent dataset without creating a volume.
+	CheckVolumeProperties(ctx context.Context, parent string, size uint64, properties map[string]string) error
+
+	// Clone creates a volume from a snapshot.
+	Clone(ctx context.Context, snapshot, name string, properties map[string]string) (*dataset, error)
+
+	// Snapshot creates a snapshot of a volume named volume@name.
+	Snapshot(ctx context.Context, volume, name string) (*dataset, error)
+
+	// Commit sets the properties on a volume, snapshots it as volume@name and
+	// sets volmode of the volume to none. The properties and the snapshot are
+	// applied atomically when the pool supports channel programs, volmode is
+	// set afterwards.
+	Commit(ctx context.Context, volume, name string, properties map[string]string) (*dataset, error)
+
+	// Rename renames a volume. The device of the volume moves to the new name.
+	Rename(ctx context.Context, name, newName string) error
+
+	// Destroy destroys a dataset.
+	Destroy(ctx context.Context, name string, flags destroyFlag) error
+
+	// SetProperties sets properties of a dataset in a single operation.
+	SetProperties(ctx context.Context, name string, properties map[string]string) error
+
+	// GetProperty returns a property of a dataset. Unset properties are
+	// returned as an empty string.
+	GetProperty(ctx context.Context, name, property string) (string, error)
+
+	// ListProperties returns the properties of the volumes directly below a
+	// dataset by volume name. Unset user properties are left out.
+	ListProperties(ctx context.Context, name string, properties ...string) (map[string]map[string]string, error)
+
+	// PoolHealth returns the health of a pool, like ONLINE, DEGRADED or
+	// SUSPENDED.
+	PoolHealth(ctx context.Context, pool string) (string, error)
+
+	// DevicePath returns the path of the block device of a volume. The device
+	// may appear some time after the volume is created.
+	DevicePath(name string) string
+
+	// Mkfs creates a file system on a device.
+	Mkfs(ctx context.Context, fs fsType, device string) error
+
+	// Resizefs grows the file system on a device to fill the device.
+	Resizefs(ctx context.Context, fs fsType, device string) error
+
+	// Cleanupfs removes default directories created by Mkfs.
+	Cleanupfs(ctx context.Context, fs fsType, mounts []mount.Mount) error
+}
@@ -0,0 +1,443 @@
+package zvol
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/errdefs"
+)
+
+// fakeVolumeManager keeps zfs datasets in memory. Volume devices are sparse
+// files in a temporary directory, file systems are only recorded.
+type fakeVolumeManager struct {
+	mu       sync.Mutex
+	root     string
+	datasets map[string]*fakeDataset
+	// fs records the file system created on each device.
+	fs map[string]fsType
+	// resized records the devices whose file system was resized.
+	resized map[string]bool
+	// updates counts the property updates of each dataset.
+	updates map[string]int
+	// mkfs is called without holding the lock before a file system is
+	// created, if set.
+	mkfs func(device string) error
+	// setProperties is called before properties are set on a dataset, if
+	// set. An error fails setting the properties.
+	setProperties func(name string, properties map[string]string) error
+	// resizefs is called before a file system is resized, if set. An error
+	// fails resizing the file system.
+	resizefs func(device string) error
+	// getDataset is called without holding the lock before a dataset is
+	// read with Get, if set. An error fails getting the dataset.
+	getDataset func(name string) error
+	// health is the health of all pools, ONLINE if empty.
+	health string
+}
+
+type fakeDataset struct {
+	dataset
+	origin     string
+	deferred   bool
+	properties map[string]string
+}
+
+var _ volumeManager = &fakeVolumeManager{}
+
+// newFakeVolumeManager returns a fake volume manager with the given
+// filesystem datasets.
+func newFakeVolumeManager(t *testing.T, filesystems ...string) *fakeVolumeManager {
+	m := &fakeVolumeManager{
+		root:     t.TempDir(),
+		datasets: make(map[string]*fakeDataset),
+		fs:       make(map[string]fsType),
+		resized:  make(map[string]bool),
+		updates:  make(map[string]int),
+	}
+	for _, name := range filesystems {
+		m.datasets[name] = &fakeDataset{
+			dataset:    dataset{Name: name, Type: datasetFilesystem},
+			properties: make(map[string]string),
+		}
+	}
+	return m
+}
+
+// names returns the names of all datasets.
+func (m *fakeVolumeManager) names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.Sorted(maps.Keys(m.datasets))
+}
+
+func (m *fakeVolumeManager) get(name string) (*fakeDataset, error) {
+	d, ok := m.datasets[name]
+	if !ok {
+		return nil, fmt.Errorf("dataset %s does not exist: %w", name, errdefs.ErrNotFound)
+	}
+	return d, nil
+}
+
+func (m *fakeVolumeManager) clones(name string) []string {
+	var clones []string
+	for _, d := range m.datasets {
+		if d.origin == name {
+			clones = append(clones, d.Name)
+		}
+	}
+	slices.Sort(clones)
+	return clones
+}
+
+func (m *fakeVolumeManager) create(name string, size uint64, origin string, properties map[string]string) (*dataset, error) {
+	if _, ok := m.datasets[name]; ok {
+		return nil, fmt.Errorf("dataset %s already exists: %w", name, errdefs.ErrAlreadyExists)
+	}
+	if _, err := m.get(filepath.Dir(name)); err != nil {
+		return nil, err
+	}
+
+	device := m.DevicePath(name)
+	if err := os.MkdirAll(filepath.Dir(device), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(device)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := f.Truncate(int64(size)); err != nil {
+		return nil, err
+	}
+
+	d := &fakeDataset{
+		dataset:    dataset{Name: name, Type: datasetVolume, Volsize: size},
+		origin:     origin,
+		properties: maps.Clone(properties),
+	}
+	if d.properties == nil {
+		d.properties = make(map[string]string)
+	}
+	m.datasets[name] = d
+
+	ds := d.dataset
+	return &ds, nil
+}
+
+func (m *fakeVolumeManager) destroy(d *fakeDataset, flags destroyFlag) error {
+	for _, child := range slices.Sorted(maps.Keys(m.datasets)) {
+		if !strings.HasPrefix(child, d.Name+"@") && !strings.HasPrefix(child, d.Name+"/") {
+			continue
+		}
+		if flags&destroyRecursive == 0 {
+			return fmt.Errorf("dataset %s has children", d.Name)
+		}
+		if err := m.destroy(m.datasets[child], destroyDefault); err != nil {
+			return err
+		}
+	}
+
+	if len(m.clones(d.Name)) > 0 {
+		if flags&destroyDeferDeletion == 0 {
+			return fmt.Errorf("snapshot %s has dependent clones", d.Name)
+		}
+		d.deferred = true
+		return nil
+	}
+
+	delete(m.datasets, d.Name)
+	if d.Type == datasetVolume {
+		if err := os.Remove(m.DevicePath(d.Name)); err != nil {
+			return err
+		}
+	}
+
+	// A snapshot marked for deferred destruction is destroyed with its last clone.
+	if origin, ok := m.datasets[d.origin]; ok && origin.deferred && len(m.clones(origin.Name)) == 0 {
+		return m.destroy(origin, destroyDefault)
+	}
+
+	return nil
+}
+
+func (m *fakeVolumeManager) Get(ctx context.Context, name string) (*dataset, error) {
+	if m.getDataset != nil {
+		if err := m.getDataset(name); err != nil {
+			return nil, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, err := m.get(name)
+	if err != nil {
+		return nil, err
+	}
+	ds := d.dataset
+	return &ds, nil
+}
+
+func (m *fakeVolumeManager) Children(ctx context.Context, name string, depth uint64) ([]*dataset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.get(name); err != nil {
+		return nil, err
+	}
+
+	var children []*dataset
+	for _, child := range slices.Sorted(maps.Keys(m.datasets)) {
+		rel, ok := strings.CutPrefix(child, name+"/")
+		if !ok {
+			continue
+		}
+		if uint64(strings.Count(rel, "/")+strings.Count(rel, "@")+1) > depth {
+			continue
+		}
+		ds := m.datasets[child].dataset
+		children = append(children, &ds)
+	}
+	return children, nil
+}
+
+func (m *fakeVolumeManager) CreateVolume(ctx context.Context, name string, size uint64, properties map[string]string) (*dataset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.create(name, size, "", properties)
+}
+
+func (m *fakeVolumeManager) CheckVolumeProperties(ctx context.Context, parent string, size uint64, properties map[string]string) error {
+	return nil
+}
+
+func (m *fakeVolumeManager) Clone(ctx context.Context, snapshot, name string, properties map[string]string) (*dataset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	origin, err := m.get(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if origin.Type != datasetSnapshot {
+		return nil, fmt.Errorf("can only clone snapshots")
+	}
+	return m.create(name, origin.Volsize, snapshot, properties)
+}
+
+func (m *fakeVolumeManager) Snapshot(ctx context.Context, volume, name string) (*dataset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, err := m.get(volume)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotName := volume + "@" + name
+	if _, ok := m.datasets[snapshotName]; ok {
+		return nil, fmt.Errorf("dataset %s already exists: %w", snapshotName, errdefs.ErrAlreadyExists)
+	}
+
+	d := &fakeDataset{
+		dataset:    dataset{Name: snapshotName, Type: datasetSnapshot, Volsize: v.Volsize},
+		properties: maps.Clone(v.properties),
+	}
+	m.datasets[snapshotName] = d
+
+	ds := d.dataset
+	return &ds, nil
+}
+
+func (m *fakeVolumeManager) Destroy(ctx context.Context, name string, flags destroyFlag) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, err := m.get(name)
+	if err != nil {
+		return err
+	}
+	return m.destroy(d, flags)
+}
+
+func (m *fakeVolumeManager) Commit(ctx context.Context, volume, name string, properties map[string]string) (*dataset, error) {
+	return commitVolume(ctx, m, volume, name, properties)
+}
+
+func (m *fakeVolumeManager) Rename(ctx context.Context, name, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, err := m.get(name)
+	if err != nil {
+		return err
+	}
+	if d.Type != datasetVolume {
+		return fmt.Errorf("can only rename volumes")
+	}
+	if _, ok := m.datasets[newName]; ok {
+		return fmt.Errorf("dataset %s already exists: %w", newName, errdefs.ErrAlreadyExists)
+	}
+	for child := range m.datasets {
+		if strings.HasPrefix(child, name+"@") {
+			return fmt.Errorf("can not rename volume %s with snapshots", name)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.DevicePath(newName)), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(m.DevicePath(name), m.DevicePath(newName)); err != nil {
+		return err
+	}
+	if fs, ok := m.fs[m.DevicePath(name)]; ok {
+		delete(m.fs, m.DevicePath(name))
+		m.fs[m.DevicePath(newName)] = fs
+	}
+
+	delete(m.datasets, name)
+	d.Name = newName
+	m.datasets[newName] = d
+	return nil
+}
+
+func (m *fakeVolumeManager) SetProperties(ctx context.Context, name string, properties map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, err := m.get(name)
+	if err != nil {
+		return err
+	}
+	if m.setProperties != nil {
+		if err := m.setProperties(name, properties); err != nil {
+			return err
+		}
+	}
+
+	m.updates[name]++
+	for property, value := range properties {
+		if property == "volsize" {
+			size, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return err
+			}
+			if err := os.Truncate(m.DevicePath(name), int64(size)); err != nil {
+				return err
+			}
+			d.Volsize = size
+			continue
+		}
+
+		d.properties[property] = value
+	}
+	return nil
+}
+
+func (m *fakeVolumeManager) GetProperty(ctx context.Context, name, property string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, err := m.get(name)
+	if err != nil {
+		return "", err
+	}
+	return m.property(d, property), nil
+}
+
+func (m *fakeVolumeManager) property(d *fakeDataset, property string) string {
+	switch property {
+	case "clones":
+		return strings.Join(m.clones(d.Name), ",")
+	case "used":
+		return strconv.FormatUint(d.Used, 10)
+	case "volsize":
+		return strconv.FormatUint(d.Volsize, 10)
+	default:
+		return d.properties[property]
+	}
+}
+
+func (m *fakeVolumeManager) PoolHealth(ctx context.Context, pool string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.get(pool); err != nil {
+		return "", err
+	}
+	if m.health == "" {
+		return "ONLINE", nil
+	}
+	return m.health, nil
+}
+
+func (m *fakeVolumeManager) ListProperties(ctx context.Context, name string, properties ...string) (map[string]map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	volumes := make(map[string]map[string]string)
+	for _, d := range m.datasets {
+		if d.Type != datasetVolume || filepath.Dir(d.Name) != name {
+			continue
+		}
+
+		props := make(map[string]string)
+		for _, property := range properties {
+			if v := m.property(d, property); v != "" || !isZfsUserProperty(property) {
+				props[property] = v
+			}
+		}
+		volumes[d.Name] = props
+	}
+	return volumes, nil
+}
+
+func (m *fakeVolumeManager) DevicePath(name string) string {
+	return filepath.Join(m.root, name)
+}
+
+func (m *fakeVolumeManager) Mkfs(ctx context.Context, fs fsType, device string) error {
+	if m.mkfs != nil {
+		if err := m.mkfs(device); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !fs.supported() {
+		return errUnsupportedFsType
+	}
+	m.fs[device] = fs
+	return nil
+}
+
+func (m *fakeVolumeManager) Resizefs(ctx context.Context, fs fsType, device string) error {
+	if m.resizefs != nil {
+		if err := m.resizefs(device); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.resized[device] = true
+	return nil
+}
+
+func (m *fakeVolumeManager) Cleanupfs(ctx context.Context, fs fsType, mounts []mount.Mount) error {
+	return nil
+}
@@ -0,0 +1,352 @@
+package zvol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/containerd/log"
+	"github.com/docker/go-units"
+	"golang.org/x/sys/unix"
+)
+
+const zfsDevice = "/dev/zfs"
+
+// Requests of the zfs ioctl interface, see include/sys/fs/zfs.h in OpenZFS.
+const (
+	zfsIocSetProp      = 0x5a16
+	zfsIocCreate       = 0x5a17
+	zfsIocDestroy      = 0x5a18
+	zfsIocSnapshot     = 0x5a23
+	zfsIocDestroySnaps = 0x5a3b
+	zfsIocClone        = 0x5a42
+)
+
+// Layout of the leading fields of zfs_cmd_t, see include/sys/zfs_ioctl.h in
+// OpenZFS. The remaining fields are only used by legacy requests and are left
+// zero.
+const (
+	zfsCmdNvlistSrc     = 4096
+	zfsCmdNvlistSrcSize = 4104
+	zfsCmdNvlistDst     = 4112
+	zfsCmdNvlistDstSize = 4120
+
+	// zfsCmdSize is larger than zfs_cmd_t, the kernel copies in and out
+	// exactly the size of its zfs_cmd_t.
+	zfsCmdSize = 16 * 1024
+	// zfsCmdNvlistDstBufferSize is the size of the buffer for error details
+	// returned by the kernel.
+	zfsCmdNvlistDstBufferSize = 16 * 1024
+
+	// dmuOstZvol is the objset type of volumes.
+	dmuOstZvol int32 = 3
+)
+
+// errUnsupportedNativeProperty is returned for properties the ioctl volume
+// manager can't encode.
+var errUnsupportedNativeProperty = errors.New("property not supported by zfs ioctl interface")
+
+// zfsNumberProperties are the numeric volume properties.
+var zfsNumberProperties = map[string]bool{
+	"copies":         true,
+	"refreservation": true,
+	"reservation":    true,
+	"snapshot_limit": true,
+	"volblocksize":   true,
+	"volsize":        true,
+}
+
+// zfsIndexProperties map the values of index properties to the numbers
+// expected by the kernel, see module/zcommon/zfs_prop.c in OpenZFS.
+var zfsIndexProperties = map[string]map[string]uint64{
+	"checksum": {
+		"on":        1,
+		"off":       2,
+		"fletcher2": 6,
+		"fletcher4": 7,
+		"sha256":    8,
+		"noparity":  10,
+		"sha512":    11,
+		"skein":     12,
+		"edonr":     13,
+		"blake3":    14,
+	},
+	"compression": {
+		"on":     1,
+		"off":    2,
+		"lzjb":   3,
+		"gzip":   10,
+		"gzip-1": 5,
+		"gzip-2": 6,
+		"gzip-3": 7,
+		"gzip-4": 8,
+		"gzip-5": 9,
+		"gzip-6": 10,
+		"gzip-7": 11,
+		"gzip-8": 12,
+		"gzip-9": 13,
+		"zle":    14,
+		"lz4":    15,
+		"zstd":   16,
+	},
+	"logbias": {
+		"latency":    0,
+		"throughput": 1,
+	},
+	"primarycache": {
+		"none":     0,
+		"metadata": 1,
+		"all":      2,
+	},
+	"readonly": {
+		"off": 0,
+		"on":  1,
+	},
+	"redundant_metadata": {
+		"all":  0,
+		"most": 1,
+		"some": 2,
+		"none": 3,
+	},
+	"secondarycache": {
+		"none":     0,
+		"metadata": 1,
+		"all":      2,
+	},
+	"snapdev": {
+		"hidden":  0,
+		"visible": 1,
+	},
+	"sync": {
+		"standard": 0,
+		"always":   1,
+		"disabled": 2,
+	},
+	"volmode": {
+		"default": 0,
+		"geom":    1,
+		"full":    1,
+		"dev":     2,
+		"none":    3,
+	},
+}
+
+// nativePropertyValue converts a property value to the type expected by the
+// kernel.
+func nativePropertyValue(name, value string) (any, error) {
+	if isZfsUserProperty(name) {
+		return value, nil
+	}
+
+	if values, ok := zfsIndexProperties[name]; ok {
+		v, ok := values[value]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s=%s", errUnsupportedNativeProperty, name, value)
+		}
+		return v, nil
+	}
+
+	if zfsNumberProperties[name] {
+		if value == "none" {
+			if name == "snapshot_limit" {
+				return uint64(math.MaxUint64), nil
+			}
+			return uint64(0), nil
+		}
+		if v, err := strconv.ParseUint(value, 10, 64); err == nil {
+			return v, nil
+		}
+		// Sizes with a binary suffix like 16K.
+		v, err := units.RAMInBytes(value)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("%w: %s=%s", errUnsupportedNativeProperty, name, value)
+		}
+		return uint64(v), nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", errUnsupportedNativeProperty, name)
+}
+
+func nativeProperties(properties map[string]string) (nvlist, error) {
+	var props nvlist
+	for _, name := range slices.Sorted(maps.Keys(properties)) {
+		value := properties[name]
+		v, err := nativePropertyValue(name, value)
+		if err != nil {
+			return nil, err
+		}
+		props = append(props, nvpair{name, v})
+	}
+	return props, nil
+}
+
+// ioctlVolumeManager creates, clones, snapshots and destroys volumes and sets
+// properties through the zfs ioctl interface, the same way libzfs_core does,
+// instead of running a zfs command for each operation. Other operations and
+// properties it can't encode are left to the zfs command line tools.
+type ioctlVolumeManager struct {
+	*zfsVolumeManager
+	dev *os.File
+}
+
+var _ volumeManager = &ioctlVolumeManager{}
+
+func newIoctlVolumeManager() (*ioctlVolumeManager, error) {
+	dev, err := os.OpenFile(zfsDevice, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zfs device: %w", err)
+	}
+
+	return &ioctlVolumeManager{
+		zfsVolumeManager: &zfsVolumeManager{},
+		dev:              dev,
+	}, nil
+}
+
+// ioctl sends a request for the named dataset or pool with the packed nvlist
+// as input.
+func (m *ioctlVolumeManager) ioctl(request uintptr, name string, input nvlist) error {
+	if len(name) >= zfsCmdNvlistSrc {
+		return fmt.Errorf("name too long: %s", name)
+	}
+
+	src, err := input.pack()
+	if err != nil {
+		return err
+	}
+	dst := make([]byte, zfsCmdNvlistDstBufferSize)
+
+	// The kernel accesses the buffers through their addresses in cmd.
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	pinner.Pin(&src[0])
+	pinner.Pin(&dst[0])
+
+	cmd := make([]byte, zfsCmdSize)
+	copy(cmd, name)
+	binary.NativeEndian.PutUint64(cmd[zfsCmdNvlistSrc:], uint64(uintptr(unsafe.Pointer(&src[0]))))
+	binary.NativeEndian.PutUint64(cmd[zfsCmdNvlistSrcSize:], uint64(len(src)))
+	binary.NativeEndian.PutUint64(cmd[zfsCmdNvlistDst:], uint64(uintptr(unsafe.Pointer(&dst[0]))))
+	binary.NativeEndian.PutUint64(cmd[zfsCmdNvlistDstSize:], uint64(len(dst)))
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, m.dev.Fd(), request, uintptr(unsafe.Pointer(&cmd[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// poolName returns the name of the pool of a dataset.
+func poolName(name string) string {
+	pool, _, _ := strings.Cut(name, "/")
+	pool, _, _ = strings.Cut(pool, "@")
+	return pool
+}
+
+func (m *ioctlVolumeManager) CreateVolume(ctx context.Context, name string, size uint64, properties map[string]string) (*dataset, error) {
+	props, err := nativeProperties(properties)
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("creating zfs volume %s with zfs command", name)
+		return m.zfsVolumeManager.CreateVolume(ctx, name, size, properties)
+	}
+	props = append(props, nvpair{"volsize", size})
+
+	if err := m.ioctl(zfsIocCreate, name, nvlist{
+		{"type", dmuOstZvol},
+		{"props", props},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to create zfs volume %s: %w", name, err)
+	}
+
+	return &dataset{Name: name, Type: datasetVolume, Volsize: size}, nil
+}
+
+// Clone returns a dataset with only the name and type set.
+func (m *ioctlVolumeManager) Clone(ctx context.Context, snapshot, name string, properties map[string]string) (*dataset, error) {
+	props, err := nativeProperties(properties)
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("cloning zfs snapshot %s with zfs command", snapshot)
+		return m.zfsVolumeManager.Clone(ctx, snapshot, name, properties)
+	}
+
+	if err := m.ioctl(zfsIocClone, name, nvlist{
+		{"origin", snapshot},
+		{"props", props},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to clone zfs snapshot %s to %s: %w", snapshot, name, err)
+	}
+
+	return &dataset{Name: name, Type: datasetVolume}, nil
+}
+
+// Snapshot returns a dataset with only the name and type set.
+func (m *ioctlVolumeManager) Snapshot(ctx context.Context, volume, name string) (*dataset, error) {
+	snapshotName := volume + "@" + name
+	if err := m.ioctl(zfsIocSnapshot, poolName(volume), nvlist{
+		{"snaps", nvlist{{snapshotName, nil}}},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to create zfs snapshot %s: %w", snapshotName, err)
+	}
+
+	return &dataset{Name: snapshotName, Type: datasetSnapshot}, nil
+}
+
+// Commit uses the zfs command to run the channel program and falls back to
+// the ioctl interface for pools that don't support it.
+func (m *ioctlVolumeManager) Commit(ctx context.Context, volume, name string, properties map[string]string) (*dataset, error) {
+	return commit(ctx, m.zfsVolumeManager, m, volume, name, properties)
+}
+
+func (m *ioctlVolumeManager) Destroy(ctx context.Context, name string, flags destroyFlag) error {
+	if flags&destroyRecursive != 0 {
+		return m.zfsVolumeManager.Destroy(ctx, name, flags)
+	}
+
+	var err error
+	if strings.Contains(name, "@") {
+		args := nvlist{{"snaps", nvlist{{name, nil}}}}
+		if flags&destroyDeferDeletion != 0 {
+			args = append(args, nvpair{"defer", nil})
+		}
+		err = m.ioctl(zfsIocDestroySnaps, poolName(name), args)
+	} else {
+		err = m.ioctl(zfsIocDestroy, name, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to destroy zfs dataset %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (m *ioctlVolumeManager) SetProperties(ctx context.Context, name string, properties map[string]string) error {
+	if len(properties) == 0 {
+		return nil
+	}
+
+	props, err := nativeProperties(properties)
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("setting properties of zfs dataset %s with zfs command", name)
+		return m.zfsVolumeManager.SetProperties(ctx, name, properties)
+	}
+
+	if err := m.ioctl(zfsIocSetProp, name, props); err != nil {
+		return fmt.Errorf("failed to set properties of zfs dataset %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// Close closes the zfs device.
+func (m *ioctlVolumeManager) Close() error {
+	return m.dev.Close()
+}
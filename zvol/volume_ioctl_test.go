@@ -0,0 +1,99 @@
+package zvol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestNativePropertyValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  any
+	}{
+		{"containerd:fs_type", "ext4", "ext4"},
+		{"compression", "lz4", uint64(15)},
+		{"volmode", "none", uint64(3)},
+		{"volmode", "full", uint64(1)},
+		{"sync", "disabled", uint64(2)},
+		{"refreservation", "none", uint64(0)},
+		{"snapshot_limit", "none", uint64(math.MaxUint64)},
+		{"volsize", "1073741824", uint64(1073741824)},
+		{"volblocksize", "16K", uint64(16384)},
+	}
+
+	for _, tt := range tests {
+		got, err := nativePropertyValue(tt.name, tt.value)
+		if err != nil {
+			t.Errorf("%s=%s: want nil, got error: %s", tt.name, tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s=%s: want %v, got %v", tt.name, tt.value, tt.want, got)
+		}
+	}
+
+	for _, prop := range [][2]string{
+		{"compression", "zstd-19"},
+		{"dedup", "on"},
+		{"keylocation", "prompt"},
+		{"volblocksize", "big"},
+	} {
+		if _, err := nativePropertyValue(prop[0], prop[1]); !errors.Is(err, errUnsupportedNativeProperty) {
+			t.Errorf("%s=%s: want %s, got %v", prop[0], prop[1], errUnsupportedNativeProperty, err)
+		}
+	}
+}
+
+// BenchmarkVolumeManager compares the backends creating, committing and
+// cloning a volume the way the snapshotter does for an image layer.
+func BenchmarkVolumeManager(b *testing.B) {
+	pool := newTestPool(b)
+	ctx := context.Background()
+
+	ioctl, err := newIoctlVolumeManager()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ioctl.Close()
+
+	for _, bm := range []struct {
+		name    string
+		volumes volumeManager
+	}{
+		{"cli", &zfsVolumeManager{}},
+		{"ioctl", ioctl},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			props := createVolumeProperties(nil)
+			for i := 0; i < b.N; i++ {
+				volume := fmt.Sprintf("%s/%s-%d", pool, bm.name, i)
+				clone := volume + "-clone"
+
+				if _, err := bm.volumes.CreateVolume(ctx, volume, 64*1024*1024, props); err != nil {
+					b.Fatal(err)
+				}
+				metadata := make(map[string]string)
+				for _, property := range zfsMetadataProperties[:len(zfsMetadataProperties)-1] {
+					metadata[property] = "value"
+				}
+				snapshot, err := bm.volumes.Commit(ctx, volume, snapshotSuffix, metadata)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := bm.volumes.Clone(ctx, snapshot.Name, clone, cloneVolumeProperties(nil)); err != nil {
+					b.Fatal(err)
+				}
+
+				for _, name := range []string{clone, snapshot.Name, volume} {
+					if err := bm.volumes.Destroy(ctx, name, destroyDefault); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package zvol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/containerd/log"
+)
+
+// zfsCommitProgram is a zfs channel program that sets user properties on a
+// volume and snapshots it in a single transaction. Its arguments are the
+// volume, the snapshot and the properties as name and value pairs. All
+// operations are checked before any of them is applied, so either all of them
+// or none of them take effect.
+const zfsCommitProgram = `
+local argv = ...
+argv = argv["argv"]
+local volume, snapshot = argv[1], argv[2]
+
+for i = 3, #argv, 2 do
+	local err = zfs.check.set_prop(volume, argv[i], argv[i + 1])
+	if err ~= 0 then
+		error("failed to set property " .. argv[i] .. " of " .. volume .. ": error " .. err)
+	end
+end
+local err = zfs.check.snapshot(snapshot)
+if err ~= 0 then
+	error("failed to create snapshot " .. snapshot .. ": error " .. err)
+end
+
+for i = 3, #argv, 2 do
+	zfs.sync.set_prop(volume, argv[i], argv[i + 1])
+end
+zfs.sync.snapshot(snapshot)
+`
+
+// zfsProbeProgram returns whether channel programs can set properties, which
+// was added in OpenZFS 2.0.
+const zfsProbeProgram = `return zfs.check.set_prop ~= nil`
+
+// errChannelProgramUnsupported is returned when a commit can't be done with
+// a channel program.
+var errChannelProgramUnsupported = errors.New("zfs channel program not supported")
+
+// runProgram runs a channel program on a pool and returns its result.
+func runProgram(ctx context.Context, pool, program string, readonly bool, args ...string) (any, error) {
+	f, err := os.CreateTemp("", "zvol-program-*.lua")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(program)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := []string{"program", "-j"}
+	if readonly {
+		cmd = append(cmd, "-n")
+	}
+	// Arguments like property values may start with a dash.
+	cmd = append(cmd, "--", pool, f.Name())
+	cmd = append(cmd, args...)
+
+	out, err := runCommand(ctx, "zfs", cmd...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run zfs channel program on %s: %s: %w", pool, strings.TrimSpace(out), err)
+	}
+
+	var result struct {
+		Return any `json:"return"`
+	}
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse zfs channel program output: %w", err)
+	}
+	return result.Return, nil
+}
+
+// channelPrograms reports whether the pool supports setting properties from
+// channel programs. The result is cached per pool.
+func (m *zfsVolumeManager) channelPrograms(ctx context.Context, pool string) bool {
+	if supported, ok := m.programs.Load(pool); ok {
+		return supported.(bool)
+	}
+
+	result, err := runProgram(ctx, pool, zfsProbeProgram, true)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("zfs channel programs are not available on pool %s, commits are not atomic", pool)
+	} else if result != true {
+		log.G(ctx).Warnf("zfs channel programs can not set properties on pool %s, commits are not atomic", pool)
+	}
+
+	supported := err == nil && result == true
+	m.programs.Store(pool, supported)
+	return supported
+}
+
+// commitProgram sets the user properties on the volume and snapshots it as
+// volume@name with a channel program. The volume is hidden afterwards by
+// hideCommittedVolume, so the commit as a whole is not atomic.
+func (m *zfsVolumeManager) commitProgram(ctx context.Context, volume, name string, properties map[string]string) (*dataset, error) {
+	pool := poolName(volume)
+	if !m.channelPrograms(ctx, pool) {
+		return nil, errChannelProgramUnsupported
+	}
+
+	snapshotName := volume + "@" + name
+	args := []string{volume, snapshotName}
+	for _, property := range slices.Sorted(maps.Keys(properties)) {
+		// Channel programs can only set user properties.
+		if !isZfsUserProperty(property) {
+			return nil, fmt.Errorf("%w: can not set property %q", errChannelProgramUnsupported, property)
+		}
+		args = append(args, property, properties[property])
+	}
+
+	if _, err := runProgram(ctx, pool, zfsCommitProgram, false, args...); err != nil {
+		return nil, fmt.Errorf("failed to commit zfs volume %s: %w", volume, err)
+	}
+
+	return &dataset{Name: snapshotName, Type: datasetSnapshot}, nil
+}
+
+// commit commits a volume with a channel program, falling back to separate
+// operations of volumes when the pool doesn't support it.
+func commit(ctx context.Context, m *zfsVolumeManager, volumes volumeManager, volume, name string, properties map[string]string) (*dataset, error) {
+	snapshot, err := m.commitProgram(ctx, volume, name, properties)
+	if errors.Is(err, errChannelProgramUnsupported) {
+		log.G(ctx).WithError(err).Debugf("committing zfs volume %s with separate operations", volume)
+		return commitVolume(ctx, volumes, volume, name, properties)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hideCommittedVolume(ctx, volumes, volume, snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// commitVolume commits a volume with separate operations. It is used when a
+// commit can't be done with a channel program.
+func commitVolume(ctx context.Context, volumes volumeManager, volume, name string, properties map[string]string) (*dataset, error) {
+	if err := volumes.SetProperties(ctx, volume, properties); err != nil {
+		return nil, err
+	}
+
+	snapshot, err := volumes.Snapshot(ctx, volume, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hideCommittedVolume(ctx, volumes, volume, snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// hideCommittedVolume hides the volume of a snapshot that was just committed.
+// Channel programs can't set volmode, so it is set after the snapshot was
+// taken. When the volume can't be hidden the snapshot is destroyed again, so
+// the failed commit can be retried. A crash before volmode is set leaves the
+// snapshot behind with the properties of the commit, the snapshotter finishes
+// such a commit when it is retried.
+func hideCommittedVolume(ctx context.Context, volumes volumeManager, volume string, snapshot *dataset) error {
+	if err := hideVolume(ctx, volumes, volume); err != nil {
+		if derr := volumes.Destroy(context.WithoutCancel(ctx), snapshot.Name, destroyDefault); derr != nil {
+			log.G(ctx).WithError(derr).Warnf("failed to destroy snapshot %s of failed commit", snapshot.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// hideVolume sets volmode to none, so the volume is not exposed outside of
+// ZFS. It can still be snapshotted and cloned.
+func hideVolume(ctx context.Context, volumes volumeManager, volume string) error {
+	return volumes.SetProperties(ctx, volume, map[string]string{"volmode": "none"})
+}
@@ -0,0 +1,221 @@
+package zvol
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/mistifyio/go-zfs/v3"
+)
+
+// zfsVolumeManager manages volumes with the zfs command line tools.
+type zfsVolumeManager struct {
+	// programs records by pool whether channel programs can be used.
+	programs sync.Map
+}
+
+var _ volumeManager = &zfsVolumeManager{}
+
+func newDataset(d *zfs.Dataset) *dataset {
+	return &dataset{
+		Name:    d.Name,
+		Type:    d.Type,
+		Used:    d.Used,
+		Avail:   d.Avail,
+		Volsize: d.Volsize,
+	}
+}
+
+func (m *zfsVolumeManager) Get(ctx context.Context, name string) (*dataset, error) {
+	d, err := zfs.GetDataset(name)
+	if err != nil {
+		return nil, err
+	}
+	return newDataset(d), nil
+}
+
+func (m *zfsVolumeManager) Children(ctx context.Context, name string, depth uint64) ([]*dataset, error) {
+	parent := &zfs.Dataset{Name: name}
+	children, err := parent.Children(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	datasets := make([]*dataset, 0, len(children))
+	for _, child := range children {
+		datasets = append(datasets, newDataset(child))
+	}
+	return datasets, nil
+}
+
+func (m *zfsVolumeManager) CreateVolume(ctx context.Context, name string, size uint64, properties map[string]string) (*dataset, error) {
+	d, err := zfs.CreateVolume(name, size, properties)
+	if err != nil {
+		return nil, err
+	}
+	return newDataset(d), nil
+}
+
+// CheckVolumeProperties asks ZFS to validate the volume properties by doing a
+// dry-run volume creation under the given dataset.
+func (m *zfsVolumeManager) CheckVolumeProperties(ctx context.Context, parent string, size uint64, properties map[string]string) error {
+	args := []string{
+		"create",
+		"-n",
+		"-V",
+		strconv.FormatUint(size, 10),
+	}
+	for _, name := range slices.Sorted(maps.Keys(properties)) {
+		args = append(args, "-o", name+"="+properties[name])
+	}
+	args = append(args, filepath.Join(parent, "properties-check"))
+
+	out, err := runCommand(ctx, "zfs", args...)
+	if err != nil {
+		return fmt.Errorf("invalid zfs volume properties: %s: %w", strings.TrimSpace(out), err)
+	}
+
+	return nil
+}
+
+func (m *zfsVolumeManager) Clone(ctx context.Context, snapshot, name string, properties map[string]string) (*dataset, error) {
+	origin := &zfs.Dataset{Name: snapshot, Type: zfs.DatasetSnapshot}
+	d, err := origin.Clone(name, properties)
+	if err != nil {
+		return nil, err
+	}
+	return newDataset(d), nil
+}
+
+func (m *zfsVolumeManager) Snapshot(ctx context.Context, volume, name string) (*dataset, error) {
+	d, err := (&zfs.Dataset{Name: volume}).Snapshot(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return newDataset(d), nil
+}
+
+func (m *zfsVolumeManager) Commit(ctx context.Context, volume, name string, properties map[string]string) (*dataset, error) {
+	return commit(ctx, m, m, volume, name, properties)
+}
+
+func (m *zfsVolumeManager) Rename(ctx context.Context, name, newName string) error {
+	_, err := (&zfs.Dataset{Name: name}).Rename(newName, false, false)
+	return err
+}
+
+func (m *zfsVolumeManager) Destroy(ctx context.Context, name string, flags destroyFlag) error {
+	zfsFlags := zfs.DestroyDefault
+	if flags&destroyRecursive != 0 {
+		zfsFlags |= zfs.DestroyRecursive
+	}
+	if flags&destroyDeferDeletion != 0 {
+		zfsFlags |= zfs.DestroyDeferDeletion
+	}
+	return (&zfs.Dataset{Name: name}).Destroy(zfsFlags)
+}
+
+func (m *zfsVolumeManager) SetProperties(ctx context.Context, name string, properties map[string]string) error {
+	if len(properties) == 0 {
+		return nil
+	}
+
+	args := []string{"set"}
+	for _, property := range slices.Sorted(maps.Keys(properties)) {
+		args = append(args, property+"="+properties[property])
+	}
+	args = append(args, name)
+
+	out, err := runCommand(ctx, "zfs", args...)
+	if err != nil {
+		return fmt.Errorf("failed to set properties of zfs dataset %s: %s: %w", name, strings.TrimSpace(out), err)
+	}
+
+	return nil
+}
+
+func (m *zfsVolumeManager) GetProperty(ctx context.Context, name, property string) (string, error) {
+	v, err := (&zfs.Dataset{Name: name}).GetProperty(property)
+	if err != nil {
+		return "", err
+	}
+	if v == "-" {
+		return "", nil
+	}
+	return v, nil
+}
+
+func (m *zfsVolumeManager) PoolHealth(ctx context.Context, pool string) (string, error) {
+	// zpool commands block while a pool is suspended, so unlike other
+	// commands it is killed when the context is done.
+	out, err := exec.CommandContext(ctx, "zpool", "list", "-H", "-o", "health", pool).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to get health of pool %s: %s: %w", pool, strings.TrimSpace(string(out)), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (m *zfsVolumeManager) ListProperties(ctx context.Context, name string, properties ...string) (map[string]map[string]string, error) {
+	args := []string{
+		"get",
+		"-H",
+		"-p",
+		"-r",
+		"-d", "1",
+		"-t", "volume",
+		"-o", "name,property,value,source",
+		strings.Join(properties, ","),
+		name,
+	}
+
+	out, err := runCommand(ctx, "zfs", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zfs properties of %s: %s: %w", name, out, err)
+	}
+
+	volumes := make(map[string]map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.SplitN(line, "\t", 4)
+		if len(fields) != 4 || fields[0] == name {
+			continue
+		}
+
+		// Unset user properties have no source.
+		if isZfsUserProperty(fields[1]) && fields[3] == "-" {
+			continue
+		}
+
+		props, ok := volumes[fields[0]]
+		if !ok {
+			props = make(map[string]string)
+			volumes[fields[0]] = props
+		}
+		props[fields[1]] = fields[2]
+	}
+
+	return volumes, nil
+}
+
+func (m *zfsVolumeManager) DevicePath(name string) string {
+	return path.Join(zfsDevicePath, name)
+}
+
+func (m *zfsVolumeManager) Mkfs(ctx context.Context, fs fsType, device string) error {
+	return mkfs(ctx, fs, device)
+}
+
+func (m *zfsVolumeManager) Resizefs(ctx context.Context, fs fsType, device string) error {
+	return resizefs(ctx, fs, device)
+}
+
+func (m *zfsVolumeManager) Cleanupfs(ctx context.Context, fs fsType, mounts []mount.Mount) error {
+	return cleanupfs(ctx, fs, mounts)
+}
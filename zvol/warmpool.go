@@ -0,0 +1,259 @@
+package zvol
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/log"
+)
+
+const (
+	// Warm pool volumes are formatted as <dataset>/warming-<fingerprint>-<n>
+	// and renamed to <dataset>/warm-<fingerprint>-<n> once they are ready.
+	// The names are not snapshot IDs, so they are ignored by reconcile and
+	// cleanup.
+	warmPoolPrefix    = "warm-"
+	warmingPoolPrefix = "warming-"
+
+	// warmPoolRetryInterval is the time to wait before retrying to refill the
+	// warm pool after formatting a volume failed.
+	warmPoolRetryInterval = 10 * time.Second
+)
+
+// warmPool keeps formatted empty volumes ready to be renamed into place for
+// snapshots without a parent, so creating them doesn't have to wait for mkfs.
+type warmPool struct {
+	volumes volumeManager
+	dataset string
+	size    uint64
+	fs      fsType
+	// fingerprint identifies the volume size, file system type and properties
+	// of the pool volumes, so volumes formatted for a different config are not
+	// used after a restart.
+	fingerprint string
+	// create creates a volume with an empty file system.
+	create func(ctx context.Context, name string) error
+
+	target      int
+	concurrency int
+
+	mu      sync.Mutex
+	ready   []string
+	filling int
+	next    uint64
+
+	refill chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newWarmPool returns the warm pool of the snapshotter for a config, filled
+// with volumes cloned from the templates when they are not nil. Ready volumes
+// left by a previous run are reused, other pool volumes are destroyed.
+func newWarmPool(ctx context.Context, s *snapshotter, config *Config, t *templates) (*warmPool, error) {
+	p := &warmPool{
+		volumes:     s.volumes,
+		dataset:     s.dataset.Name,
+		size:        config.volumeSizeBytes,
+		fs:          config.FileSystemType,
+		fingerprint: volumeFingerprint(config.volumeSizeBytes, config.FileSystemType, createVolumeProperties(config.VolumeProperties)),
+		target:      config.WarmPoolSize,
+		concurrency: config.WarmPoolConcurrency,
+		refill:      make(chan struct{}, 1),
+	}
+	p.create = func(ctx context.Context, name string) error {
+		_, err := s.createEmptyVolume(ctx, config, t, name, p.size, p.fs, nil, nil)
+		return err
+	}
+
+	children, err := p.volumes.Children(ctx, p.dataset, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, child := range children {
+		name := path.Base(child.Name)
+		if !strings.HasPrefix(name, warmPoolPrefix) && !strings.HasPrefix(name, warmingPoolPrefix) {
+			continue
+		}
+
+		if seq, ok := p.parseName(name); ok {
+			p.ready = append(p.ready, child.Name)
+			p.next = max(p.next, seq+1)
+			continue
+		}
+
+		if err := p.volumes.Destroy(ctx, child.Name, destroyDefault); err != nil {
+			return nil, fmt.Errorf("failed to destroy warm pool volume %s: %w", child.Name, err)
+		}
+		log.G(ctx).Debugf("destroyed stale warm pool volume %s", child.Name)
+	}
+	warmPoolVolumes.WithLabelValues(p.dataset).Set(float64(len(p.ready)))
+
+	return p, nil
+}
+
+// volumeFingerprint returns a short hash of the volume size, file system
+// type, mkfs options and properties of a formatted empty volume.
+func volumeFingerprint(size uint64, fs fsType, properties map[string]string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00", size, fs)
+	if command, args, err := mkfsCommand(fs, ""); err == nil {
+		fmt.Fprintf(h, "%s %s\x00", command, strings.Join(args, " "))
+	}
+	for _, name := range slices.Sorted(maps.Keys(properties)) {
+		fmt.Fprintf(h, "%s=%s\x00", name, properties[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// parseName returns the sequence number of a ready pool volume matching the
+// fingerprint of the pool.
+func (p *warmPool) parseName(name string) (uint64, bool) {
+	seq, ok := strings.CutPrefix(name, warmPoolPrefix+p.fingerprint+"-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// start starts refilling the pool in the background.
+func (p *warmPool) start(ctx context.Context) {
+	ctx, p.cancel = context.WithCancel(ctx)
+	for range p.concurrency {
+		p.wg.Add(1)
+		go p.run(ctx)
+	}
+	p.wake()
+}
+
+// close stops refilling the pool and waits for volumes being formatted. Ready
+// volumes are kept for the next run.
+func (p *warmPool) close() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	p.wg.Wait()
+}
+
+// wake wakes up a worker to refill the pool.
+func (p *warmPool) wake() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// matches reports whether a volume can be taken from the pool.
+func (p *warmPool) matches(req *volumeRequest) bool {
+	return req.parentID == "" && req.size == p.size && req.fs == p.fs && len(req.labelProperties) == 0
+}
+
+// take returns a formatted volume from the pool. The volume must be renamed
+// or destroyed by the caller.
+func (p *warmPool) take() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.wake()
+
+	if len(p.ready) == 0 {
+		warmPoolMisses.WithLabelValues(p.dataset).Inc()
+		return "", false
+	}
+
+	name := p.ready[0]
+	p.ready = p.ready[1:]
+	warmPoolHits.WithLabelValues(p.dataset).Inc()
+	warmPoolVolumes.WithLabelValues(p.dataset).Set(float64(len(p.ready)))
+	return name, true
+}
+
+func (p *warmPool) run(ctx context.Context) {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.refill:
+		}
+
+		for p.fill(ctx) {
+		}
+	}
+}
+
+// fill formats a volume when the pool is not full and reports whether it
+// should be called again.
+func (p *warmPool) fill(ctx context.Context) bool {
+	p.mu.Lock()
+	if ctx.Err() != nil || len(p.ready)+p.filling >= p.target {
+		p.mu.Unlock()
+		return false
+	}
+	p.filling++
+	seq := p.next
+	p.next++
+	p.mu.Unlock()
+
+	// Let another worker format the next volume in parallel.
+	p.wake()
+
+	name, err := p.createVolume(ctx, seq)
+
+	p.mu.Lock()
+	p.filling--
+	if err == nil {
+		p.ready = append(p.ready, name)
+		warmPoolVolumes.WithLabelValues(p.dataset).Set(float64(len(p.ready)))
+	}
+	p.mu.Unlock()
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		log.G(ctx).WithError(err).Warn("failed to refill warm pool")
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(warmPoolRetryInterval):
+		}
+	}
+	return true
+}
+
+// createVolume formats a new pool volume. The volume is only renamed to a ready
+// pool volume when it is formatted, volumes left behind by a crash are
+// destroyed by newWarmPool.
+func (p *warmPool) createVolume(ctx context.Context, seq uint64) (string, error) {
+	warming := path.Join(p.dataset, fmt.Sprintf("%s%s-%d", warmingPoolPrefix, p.fingerprint, seq))
+	name := path.Join(p.dataset, fmt.Sprintf("%s%s-%d", warmPoolPrefix, p.fingerprint, seq))
+
+	if err := p.create(ctx, warming); err != nil {
+		return "", err
+	}
+
+	if err := p.volumes.Rename(ctx, warming, name); err != nil {
+		if derr := p.volumes.Destroy(context.WithoutCancel(ctx), warming, destroyDefault); derr != nil {
+			log.G(ctx).WithError(derr).Warnf("failed to destroy warm pool volume %s", warming)
+		}
+		return "", err
+	}
+
+	log.G(ctx).Debugf("formatted warm pool volume %s", name)
+	return name, nil
+}
@@ -0,0 +1,118 @@
+package zvol
+
+import (
+	"context"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// waitForWarmPool waits until the warm pool has n ready volumes.
+func waitForWarmPool(t *testing.T, p *warmPool, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		ready := len(p.ready)
+		p.mu.Unlock()
+		if ready == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want %d ready warm pool volumes, got %d", n, ready)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSnapshotterWarmPool(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{WarmPoolSize: 2, WarmPoolConcurrency: 2}
+	s, volumes := newTestSnapshotter(t, config)
+	waitForWarmPool(t, s.warmPool, 2)
+
+	hits := testutil.ToFloat64(warmPoolHits.WithLabelValues(testDataset))
+	misses := testutil.ToFloat64(warmPoolMisses.WithLabelValues(testDataset))
+
+	t.Run("take", func(t *testing.T) {
+		mounts, err := s.Prepare(ctx, "base", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := volumes.DevicePath(testDataset + "/1"); mounts[0].Source != want {
+			t.Errorf("want mount source %q, got %q", want, mounts[0].Source)
+		}
+		if fs := volumes.fs[mounts[0].Source]; fs != fsTypeExt4 {
+			t.Errorf("want file system %q, got %q", fsTypeExt4, fs)
+		}
+		if v, _ := volumes.GetProperty(ctx, testDataset+"/1", zfsMetadataKeyProperty); v != "base" {
+			t.Errorf("want metadata key %q, got %q", "base", v)
+		}
+
+		if got := testutil.ToFloat64(warmPoolHits.WithLabelValues(testDataset)) - hits; got != 1 {
+			t.Errorf("want 1 hit, got %v", got)
+		}
+		waitForWarmPool(t, s.warmPool, 2)
+	})
+
+	t.Run("size mismatch", func(t *testing.T) {
+		if _, err := s.Prepare(ctx, "large", "", snapshots.WithLabels(map[string]string{
+			LabelVolumeSize: "2147483648",
+		})); err != nil {
+			t.Fatal(err)
+		}
+		if got := testutil.ToFloat64(warmPoolHits.WithLabelValues(testDataset)) - hits; got != 1 {
+			t.Errorf("want 1 hit, got %v", got)
+		}
+		if got := testutil.ToFloat64(warmPoolMisses.WithLabelValues(testDataset)) - misses; got != 0 {
+			t.Errorf("want 0 misses, got %v", got)
+		}
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		s.warmPool.close()
+		ready := s.warmPool.ready
+
+		// Volumes that were being formatted or were formatted for another
+		// config are destroyed.
+		for _, name := range []string{"warming-0123456789ab-7", "warm-0123456789ab-8"} {
+			if _, err := volumes.CreateVolume(ctx, testDataset+"/"+name, 1024, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		p, err := newWarmPool(ctx, s, s.config, s.templates)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p.ready) != len(ready) {
+			t.Errorf("want ready volumes %v, got %v", ready, p.ready)
+		}
+		for _, name := range volumes.names() {
+			if strings.HasPrefix(path.Base(name), warmingPoolPrefix) || strings.Contains(name, "0123456789ab") {
+				t.Errorf("expected stale warm pool volume %s to be destroyed", name)
+			}
+		}
+	})
+}
+
+func TestVolumeFingerprint(t *testing.T) {
+	a := volumeFingerprint(1024, fsTypeExt4, map[string]string{"compression": "lz4"})
+	if b := volumeFingerprint(1024, fsTypeExt4, map[string]string{"compression": "lz4"}); a != b {
+		t.Errorf("want equal fingerprints, got %s and %s", a, b)
+	}
+	for _, b := range []string{
+		volumeFingerprint(2048, fsTypeExt4, map[string]string{"compression": "lz4"}),
+		volumeFingerprint(1024, fsTypeXfs, map[string]string{"compression": "lz4"}),
+		volumeFingerprint(1024, fsTypeExt4, map[string]string{"compression": "zstd"}),
+	} {
+		if a == b {
+			t.Errorf("want different fingerprints, got %s", a)
+		}
+	}
+}